@@ -0,0 +1,123 @@
+package apierror
+
+import (
+	"net/http"
+)
+
+// Stable codes identifying errors, clients can rely on them instead of messages
+const (
+	CodeBadRequest          = "bad_request"
+	CodeInvalidArgument     = "invalid_argument"
+	CodeInvalidBody         = "invalid_body"
+	CodeValidationFailed    = "validation_failed"
+	CodeUnauthorized        = "unauthorized"
+	CodeForbidden           = "forbidden"
+	CodeNotFound            = "not_found"
+	CodeConflict            = "conflict"
+	CodeUniqueViolation     = "unique_violation"
+	CodeForeignKeyViolation = "foreign_key_violation"
+	CodeNotNullViolation    = "not_null_violation"
+	CodeCheckViolation      = "check_violation"
+	CodeInvalidValue        = "invalid_value"
+	CodeUndefinedTable      = "undefined_table"
+	CodeUndefinedColumn     = "undefined_column"
+	CodeTooManyRequests     = "too_many_requests"
+	CodeNotConnected        = "not_connected"
+	CodeInternal            = "internal_error"
+)
+
+// Error is answered to clients with its HTTP status, a stable code and what caused it
+type Error struct {
+	Status     int         `json:"-"`
+	Code       string      `json:"code"`
+	Message    string      `json:"-"`
+	Table      string      `json:"table,omitempty"`
+	Column     string      `json:"column,omitempty"`
+	Constraint string      `json:"constraint,omitempty"`
+	Details    interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// New creates an error with a HTTP status and a stable code
+func New(status int, code string, message string) *Error {
+	return &Error{Status: status, Code: code, Message: message}
+}
+
+// WithDetails adds details to an error
+func (e *Error) WithDetails(details interface{}) *Error {
+	e.Details = details
+	return e
+}
+
+// WithTable adds the table that caused an error
+func (e *Error) WithTable(table string) *Error {
+	e.Table = table
+	return e
+}
+
+// CodeFromStatus returns the code of errors carrying no code of their own
+func CodeFromStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusUnprocessableEntity:
+		return CodeValidationFailed
+	case http.StatusTooManyRequests:
+		return CodeTooManyRequests
+	}
+	return CodeInternal
+}
+
+// From converts any error into an Error with the given status when it is not one already
+func From(err error, status int) *Error {
+	if apiErr, ok := err.(*Error); ok {
+		return apiErr
+	}
+	return New(status, CodeFromStatus(status), err.Error())
+}
+
+// Problem is the RFC 7807 representation of an error, codes and involved objects are extension members
+type Problem struct {
+	Type       string      `json:"type"`
+	Title      string      `json:"title"`
+	Status     int         `json:"status"`
+	Detail     string      `json:"detail,omitempty"`
+	Instance   string      `json:"instance,omitempty"`
+	Code       string      `json:"code"`
+	Table      string      `json:"table,omitempty"`
+	Column     string      `json:"column,omitempty"`
+	Constraint string      `json:"constraint,omitempty"`
+	Details    interface{} `json:"details,omitempty"`
+}
+
+// Problem converts an error into problem details
+// Its type is the code appended to typeBase, or about:blank without typeBase
+func (e *Error) Problem(typeBase string, instance string) Problem {
+	problemType := "about:blank"
+	if typeBase != "" {
+		problemType = typeBase + e.Code
+	}
+	return Problem{
+		Type:       problemType,
+		Title:      http.StatusText(e.Status),
+		Status:     e.Status,
+		Detail:     e.Message,
+		Instance:   instance,
+		Code:       e.Code,
+		Table:      e.Table,
+		Column:     e.Column,
+		Constraint: e.Constraint,
+		Details:    e.Details,
+	}
+}
@@ -0,0 +1,67 @@
+package apierror
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestFrom(t *testing.T) {
+	type args struct {
+		err    error
+		status int
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name: "Already an Error",
+			args: args{
+				err:    New(http.StatusConflict, CodeUniqueViolation, "duplicate key"),
+				status: http.StatusInternalServerError,
+			},
+			wantStatus: http.StatusConflict,
+			wantCode:   CodeUniqueViolation,
+		},
+		{
+			name: "Plain error",
+			args: args{
+				err:    errors.New("sql: no rows in result set"),
+				status: http.StatusNotFound,
+			},
+			wantStatus: http.StatusNotFound,
+			wantCode:   CodeNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := From(tt.args.err, tt.args.status)
+			if got.Status != tt.wantStatus || got.Code != tt.wantCode {
+				t.Errorf("From() = %v %v, want %v %v", got.Status, got.Code, tt.wantStatus, tt.wantCode)
+			}
+			if got.Error() != tt.args.err.Error() {
+				t.Errorf("From() message = %v, want %v", got.Error(), tt.args.err.Error())
+			}
+		})
+	}
+}
+
+func TestProblem(t *testing.T) {
+	err := New(http.StatusConflict, CodeUniqueViolation, "duplicate key").WithTable("crudify")
+
+	got := err.Problem("", "urn:uuid:1234")
+	if got.Type != "about:blank" || got.Title != "Conflict" || got.Status != http.StatusConflict {
+		t.Errorf("Problem() = %+v, want about:blank Conflict 409", got)
+	}
+	if got.Detail != "duplicate key" || got.Instance != "urn:uuid:1234" || got.Code != CodeUniqueViolation || got.Table != "crudify" {
+		t.Errorf("Problem() = %+v, want detail, instance, code and table filled", got)
+	}
+
+	got = err.Problem("https://example.com/problems/", "")
+	if got.Type != "https://example.com/problems/"+CodeUniqueViolation {
+		t.Errorf("Problem() type = %v, want %v", got.Type, "https://example.com/problems/"+CodeUniqueViolation)
+	}
+}
@@ -0,0 +1,183 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/handler"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Header holding an API key, keys are also accepted as "Authorization: ApiKey <key>"
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyEnabled tells if a table of API keys is configured
+func APIKeyEnabled(apikeyinfo config.APIKeyInfo) bool {
+	return apikeyinfo.Table != ""
+}
+
+// NewAPIKey generates a random key along with the hash to store in the table of API keys
+func NewAPIKey() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	key := base64.RawURLEncoding.EncodeToString(raw)
+	return key, HashAPIKey(key), nil
+}
+
+// HashAPIKey returns the hex encoded SHA-256 of a key, keys are random so they need no salt
+func HashAPIKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// GetAPIKey returns the key presented by a request
+func GetAPIKey(r *http.Request) string {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return strings.TrimSpace(key)
+	}
+	auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(auth) == 2 && auth[0] == "ApiKey" {
+		return strings.TrimSpace(auth[1])
+	}
+	return ""
+}
+
+// GetAPIKeyID returns the id of the API key that authenticated a request
+func GetAPIKeyID(r *http.Request) string {
+	if r != nil {
+		if id, ok := r.Context().Value("apikey").(string); ok {
+			return id
+		}
+	}
+	return ""
+}
+
+// ScopeAllows tells if space separated scopes allow a verb on a table
+// A scope is "table:VERB", where table or verb may be "*", and "*" allows everything
+func ScopeAllows(scopes string, tablename string, verb string) bool {
+	for _, scope := range strings.Fields(scopes) {
+		if scope == "*" {
+			return true
+		}
+		pair := strings.SplitN(scope, ":", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		if (pair[0] == "*" || pair[0] == tablename) && (pair[1] == "*" || strings.EqualFold(pair[1], verb)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answer a failed API key authentication
+func sendAPIKeyError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Log(r).Warn().Msg(err.Error())
+	if apiErr, ok := err.(*apierror.Error); ok && apiErr.Status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `ApiKey realm="`+BasicRealm+`"`)
+	}
+	err = handler.SendAnswer(w, r, nil, err)
+	if err != nil {
+		logger.Log(r).Warn().Msg(err.Error())
+	}
+}
+
+// Minimum delay between two updates of the last use of a key
+var APIKeyTouchInterval = time.Minute
+
+// Last time each key was recorded as used, by id
+var (
+	touchedAPIKeys = map[string]time.Time{}
+	touchMutex     sync.Mutex
+)
+
+// Record when a key was used last, without delaying the request
+// The update is throttled per key and is not published to events
+func touchAPIKey(r *http.Request, apikeyinfo config.APIKeyInfo, id interface{}) {
+	connection := dbhelper.GetConnection()
+	if connection == nil {
+		return
+	}
+	now := time.Now()
+	key := fmt.Sprintf("%v", id)
+	touchMutex.Lock()
+	if last, ok := touchedAPIKeys[key]; ok && now.Sub(last) < APIKeyTouchInterval {
+		touchMutex.Unlock()
+		return
+	}
+	touchedAPIKeys[key] = now
+	touchMutex.Unlock()
+
+	log := logger.Log(r)
+	query := "UPDATE " + connection.Dialect.QuoteIdent(apikeyinfo.Table) + " SET " + connection.Dialect.QuoteIdent("last_used_at") + " = " +
+		connection.Dialect.Placeholder(0) + " WHERE " + connection.Dialect.QuoteIdent("id") + " = " + connection.Dialect.Placeholder(1)
+	go func() {
+		if _, err := connection.DB.Exec(query, now, id); err != nil {
+			log.Warn().Msg("Cannot record last use of API key: " + err.Error())
+		}
+	}()
+}
+
+// APIKey authenticates requests holding an API key, looked up by hash in the table of API keys
+// whose id, hash, scopes, revoked_at and last_used_at columns describe each key
+// Requests without key are passed to fallback, or rejected when fallback is nil
+func APIKey(inner http.Handler, fallback http.Handler, apikeyinfo config.APIKeyInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := GetAPIKey(r)
+		if key == "" && fallback != nil {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		logger.Log(r).Debug().Msg("Verifying API key")
+
+		if key == "" {
+			sendAPIKeyError(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Authorization failed : missing API key"))
+			return
+		}
+
+		keys, err := dbhelper.SelectWithQuery(r, []string{"id", "scopes", "revoked_at"}, apikeyinfo.Table, map[string]string{}, []dbhelper.Builder{
+			{Column: "hash", Value: HashAPIKey(key), Operand: "="},
+		})
+		if err != nil {
+			logger.Log(r).Error().Msg(err.Error())
+			err = handler.SendAnswer(w, r, nil, err)
+			if err != nil {
+				logger.Log(r).Warn().Msg(err.Error())
+			}
+			return
+		}
+		if keys == nil || len(*keys) != 1 {
+			sendAPIKeyError(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Authorization failed : unknown API key"))
+			return
+		}
+		apikey := (*keys)[0]
+		if apikey["revoked_at"] != nil {
+			sendAPIKeyError(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Authorization failed : API key is revoked"))
+			return
+		}
+
+		tablename := handler.GetTableName(r)
+		if !ScopeAllows(fmt.Sprintf("%v", apikey["scopes"]), tablename, r.Method) {
+			sendAPIKeyError(w, r, apierror.New(http.StatusForbidden, apierror.CodeForbidden, "API key is not allowed to "+r.Method+" on "+tablename))
+			return
+		}
+
+		touchAPIKey(r, apikeyinfo, apikey["id"])
+		ctx := context.WithValue(r.Context(), "apikey", fmt.Sprintf("%v", apikey["id"]))
+		inner.ServeHTTP(w, r.WithContext(context.WithValue(ctx, "role", APIKeyRole)))
+	})
+}
@@ -1,21 +1,102 @@
 package auth
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/base64"
-	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
+	"github.com/maxime1907/crudify/apierror"
 	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
 	"github.com/maxime1907/crudify/logger"
 	"github.com/maxime1907/crudify/handler"
 )
 
+// Realm sent in basic auth challenges
+var BasicRealm = "crudify"
+
+// Hash compared when a user does not exist, so that unknown users take as long as wrong passwords
+const dummyHash = "$2a$10$TcFDIjHBzZKjIsxXEkJbu.TmD7TLp8oyqc7TKy0aFvwm5PXepxVbC"
+
+// BasicEnabled tells if users are configured for basic auth
+func BasicEnabled(routerinfo config.RouterInfo) bool {
+	return (routerinfo.Username != "" && routerinfo.Password != "") || len(routerinfo.Users) > 0 || routerinfo.UsersTable != ""
+}
+
+// Validate checks credentials against the configured user and the list of users with bcrypt hashes
 func Validate(username string, password string, routerinfo config.RouterInfo) bool {
-    if username == routerinfo.Username && password == routerinfo.Password {
-        return true
-    }
-    return false
+	if routerinfo.Username != "" && routerinfo.Password != "" {
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(routerinfo.Username))
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(routerinfo.Password))
+		if usernameMatch&passwordMatch == 1 {
+			return true
+		}
+	}
+	for _, user := range routerinfo.Users {
+		if subtle.ConstantTimeCompare([]byte(username), []byte(user.Username)) == 1 {
+			return handler.VerifyHash(password, user.Hash) == nil
+		}
+	}
+	if routerinfo.UsersTable == "" {
+		handler.VerifyHash(password, dummyHash)
+	}
+	return false
+}
+
+// ValidateUser checks credentials against configured users, then against the users table
+// whose username and hash columns hold bcrypt hashes
+func ValidateUser(r *http.Request, username string, password string, routerinfo config.RouterInfo) (bool, error) {
+	if Validate(username, password, routerinfo) {
+		return true, nil
+	}
+	if routerinfo.UsersTable == "" {
+		return false, nil
+	}
+
+	users, err := dbhelper.SelectWithQuery(r, []string{"hash"}, routerinfo.UsersTable, map[string]string{}, []dbhelper.Builder{
+		{Column: "username", Value: username, Operand: "="},
+	})
+	if err != nil {
+		return false, err
+	}
+	if users == nil || len(*users) != 1 {
+		handler.VerifyHash(password, dummyHash)
+		return false, nil
+	}
+	return handler.VerifyHash(password, fmt.Sprintf("%v", (*users)[0]["hash"])) == nil, nil
+}
+
+// Role of a basic auth user, its username unless configured
+func userRole(username string, routerinfo config.RouterInfo) string {
+	for _, user := range routerinfo.Users {
+		if user.Username == username && user.Role != "" {
+			return user.Role
+		}
+	}
+	return username
+}
+
+// GetUsername returns the user authenticated by basic auth
+func GetUsername(r *http.Request) string {
+	if r != nil {
+		if username, ok := r.Context().Value("username").(string); ok {
+			return username
+		}
+	}
+	return ""
+}
+
+// Answer a failed basic authentication with a challenge
+func sendBasicError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Log(r).Warn().Msg(err.Error())
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+BasicRealm+`", charset="UTF-8"`)
+	err = handler.SendAnswer(w, r, nil, err)
+	if err != nil {
+		logger.Log(r).Warn().Msg(err.Error())
+	}
 }
 
 func BasicAuth(inner http.Handler, routerinfo config.RouterInfo) http.Handler {
@@ -25,29 +106,34 @@ func BasicAuth(inner http.Handler, routerinfo config.RouterInfo) http.Handler {
 
 		auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
 
-        if len(auth) != 2 || auth[0] != "Basic" {
-			err := errors.New("Authorization failed : not a basic auth")
-			logger.Log(r).Warn().Msg(err.Error())
-			err = handler.SendAnswer(w, r, nil, err)
-			if err != nil {
-				logger.Log(r).Warn().Msg(err.Error())
-			}
-            return
-        }
+		if len(auth) != 2 || auth[0] != "Basic" {
+			sendBasicError(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Authorization failed : not a basic auth"))
+			return
+		}
 
-        payload, _ := base64.StdEncoding.DecodeString(auth[1])
-        pair := strings.SplitN(string(payload), ":", 2)
+		payload, _ := base64.StdEncoding.DecodeString(auth[1])
+		pair := strings.SplitN(string(payload), ":", 2)
+		if len(pair) != 2 {
+			sendBasicError(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Authorization failed : username and password does not match"))
+			return
+		}
 
-        if len(pair) != 2 || !Validate(pair[0], pair[1], routerinfo) {
-			err := errors.New("Authorization failed : username and password does not match")
-			logger.Log(r).Warn().Msg(err.Error())
+		valid, err := ValidateUser(r, pair[0], pair[1], routerinfo)
+		if err != nil {
+			logger.Log(r).Error().Msg(err.Error())
 			err = handler.SendAnswer(w, r, nil, err)
 			if err != nil {
 				logger.Log(r).Warn().Msg(err.Error())
 			}
-            return
+			return
+		}
+		if !valid {
+			sendBasicError(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Authorization failed : username and password does not match"))
+			return
 		}
 
-		inner.ServeHTTP(w, r)
+		ctx := context.WithValue(r.Context(), "username", pair[0])
+		ctx = context.WithValue(ctx, "role", userRole(pair[0], routerinfo))
+		inner.ServeHTTP(w, r.WithContext(ctx))
 	})
-}
\ No newline at end of file
+}
@@ -0,0 +1,376 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/handler"
+)
+
+// Sign claims with a secret, a *rsa.PrivateKey or an *ecdsa.PrivateKey
+func signJWT(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch mykey := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, mykey)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, mykey, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, mykey, hash[:])
+		if err == nil {
+			signature = make([]byte, 64)
+			r.FillBytes(signature[:32])
+			s.FillBytes(signature[32:])
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestValidate(t *testing.T) {
+	hash, err := handler.HashAndSalt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routerinfo := config.RouterInfo{
+		Username: "user",
+		Password: "pass",
+		Users:    []config.UserInfo{{Username: "alice", Hash: hash}},
+	}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		want     bool
+	}{
+		{"Configured user", "user", "pass", true},
+		{"Configured user with wrong password", "user", "wrong", false},
+		{"Hashed user", "alice", "secret", true},
+		{"Hashed user with wrong password", "alice", "pass", false},
+		{"Unknown user", "bob", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Validate(tt.username, tt.password, routerinfo); got != tt.want {
+				t.Errorf("Validate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	hash, err := handler.HashAndSalt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routerinfo := config.RouterInfo{Users: []config.UserInfo{{Username: "alice", Hash: hash}}}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetUsername(r) != "alice" {
+			t.Errorf("BasicAuth() username = %v, want alice", GetUsername(r))
+		}
+	})
+
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		wantStatus int
+	}{
+		{"Valid credentials", "alice", "secret", http.StatusOK},
+		{"Invalid credentials", "alice", "wrong", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.SetBasicAuth(tt.username, tt.password)
+			BasicAuth(inner, routerinfo).ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("BasicAuth() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Basic realm=") {
+				t.Errorf("BasicAuth() challenge = %v", w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestParseJWT(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []JWTKey{
+		{Algorithm: HS256, Key: secret},
+		{Kid: "rsa", Algorithm: RS256, Key: &rsaKey.PublicKey},
+		{Kid: "ec", Algorithm: ES256, Key: &ecKey.PublicKey},
+	}
+	now := time.Unix(1000000, 0)
+	valid := map[string]interface{}{"sub": "42", "exp": 1000060, "nbf": 999990, "aud": []string{"api"}, "iss": "issuer"}
+	jwtinfo := config.JWTInfo{Audience: "api", Issuer: "issuer"}
+
+	tests := []struct {
+		name    string
+		token   string
+		jwtinfo config.JWTInfo
+		wantErr bool
+	}{
+		{"HS256", signJWT(t, HS256, "", secret, valid), jwtinfo, false},
+		{"RS256", signJWT(t, RS256, "rsa", rsaKey, valid), jwtinfo, false},
+		{"ES256", signJWT(t, ES256, "ec", ecKey, valid), jwtinfo, false},
+		{"Wrong secret", signJWT(t, HS256, "", []byte("other"), valid), jwtinfo, true},
+		{"Wrong kid", signJWT(t, RS256, "ec", rsaKey, valid), jwtinfo, true},
+		{"Unexpected algorithm", signJWT(t, HS256, "", secret, valid), config.JWTInfo{Algorithm: RS256}, true},
+		{"None algorithm", signJWT(t, "none", "", secret, valid), config.JWTInfo{}, true},
+		{"Expired", signJWT(t, HS256, "", secret, map[string]interface{}{"exp": 999000}), config.JWTInfo{}, true},
+		{"Expired within leeway", signJWT(t, HS256, "", secret, map[string]interface{}{"exp": 999990}), config.JWTInfo{Leeway: 30}, false},
+		{"Not valid yet", signJWT(t, HS256, "", secret, map[string]interface{}{"nbf": 1000100}), config.JWTInfo{}, true},
+		{"Wrong audience", signJWT(t, HS256, "", secret, map[string]interface{}{"aud": "other"}), jwtinfo, true},
+		{"Wrong issuer", signJWT(t, HS256, "", secret, map[string]interface{}{"aud": "api", "iss": "other"}), jwtinfo, true},
+		{"Malformed", "not.a.token", jwtinfo, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ParseJWT(tt.token, keys, tt.jwtinfo, now)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseJWT() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && claims == nil {
+				t.Errorf("ParseJWT() claims = %v, want claims", claims)
+			}
+		})
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParsePEMKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil || key.Algorithm != RS256 {
+		t.Errorf("ParsePEMKey() = %v %v, want a RS256 key", key.Algorithm, err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks := `{"keys":[` +
+		`{"kty":"oct","kid":"hs","k":"` + encode([]byte("secret")) + `"},` +
+		`{"kty":"RSA","kid":"rsa","use":"sig","n":"` + encode(rsaKey.N.Bytes()) + `","e":"AQAB"},` +
+		`{"kty":"EC","kid":"ec","crv":"P-256","x":"` + encode(ecKey.X.Bytes()) + `","y":"` + encode(ecKey.Y.Bytes()) + `"},` +
+		`{"kty":"RSA","kid":"enc","use":"enc","n":"AQAB","e":"AQAB"}]}`
+	keys, err := ParseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatalf("ParseJWKS() error = %v", err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("ParseJWKS() = %v keys, want 3", len(keys))
+	}
+	token := signJWT(t, ES256, "ec", ecKey, map[string]interface{}{"sub": "42"})
+	if _, err := ParseJWT(token, keys, config.JWTInfo{}, time.Now()); err != nil {
+		t.Errorf("ParseJWT() with JWKS keys error = %v", err)
+	}
+}
+
+func TestJWT(t *testing.T) {
+	jwtinfo := config.JWTInfo{Secret: "secret", SetRole: true}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims := GetClaims(r)
+		session, ok := dbhelper.GetSession(r)
+		if claims["sub"] != "42" || !ok || session.Role != "reader" || session.Settings[ClaimsSetting] == "" {
+			t.Errorf("JWT() claims = %v, session = %v", claims, session)
+		}
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		defaultRole   string
+		wantStatus    int
+	}{
+		{"Valid token", "Bearer " + signJWT(t, HS256, "", []byte("secret"), map[string]interface{}{"sub": "42", "role": "reader"}), "anonymous", http.StatusOK},
+		{"Invalid token", "Bearer " + signJWT(t, HS256, "", []byte("other"), map[string]interface{}{"sub": "42"}), "anonymous", http.StatusUnauthorized},
+		{"Not a bearer token", "Basic dXNlcjpwYXNz", "anonymous", http.StatusUnauthorized},
+		{"No role and no default role", "Bearer " + signJWT(t, HS256, "", []byte("secret"), map[string]interface{}{"sub": "42"}), "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.Header.Set("Authorization", tt.authorization)
+			jwtinfo.DefaultRole = tt.defaultRole
+			JWT(inner, jwtinfo).ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("JWT() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("JWT() is missing a WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		name   string
+		scopes string
+		table  string
+		verb   string
+		want   bool
+	}{
+		{"Every table and verb", "*", "crudify", "DELETE", true},
+		{"Table and verb", "crudify:GET crudify:POST", "crudify", "POST", true},
+		{"Other verb", "crudify:GET crudify:POST", "crudify", "DELETE", false},
+		{"Other table", "crudify:GET", "crudify_item", "GET", false},
+		{"Every verb of a table", "crudify:*", "crudify", "PUT", true},
+		{"A verb on every table", "*:get", "crudify_item", "GET", true},
+		{"No scope", "", "crudify", "GET", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ScopeAllows(tt.scopes, tt.table, tt.verb); got != tt.want {
+				t.Errorf("ScopeAllows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	key, hash, err := NewAPIKey()
+	if err != nil || HashAPIKey(key) != hash {
+		t.Fatalf("NewAPIKey() = %v %v %v", key, hash, err)
+	}
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("Authorization", "ApiKey "+key)
+	if got := GetAPIKey(req); got != key {
+		t.Errorf("GetAPIKey() = %v, want %v", got, key)
+	}
+
+	apikeyinfo := config.APIKeyInfo{Table: "crudify_api_key"}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+
+	w := httptest.NewRecorder()
+	APIKey(inner, fallback, apikeyinfo).ServeHTTP(w, httptest.NewRequest("GET", "/test", nil))
+	if w.Code != http.StatusTeapot {
+		t.Errorf("APIKey() without key status = %v, want fallback", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	APIKey(inner, nil, apikeyinfo).ServeHTTP(w, httptest.NewRequest("GET", "/test", nil))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("APIKey() without key status = %v, want %v with a challenge", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestFindPolicy(t *testing.T) {
+	policies := []config.PolicyInfo{
+		{Role: "reader", Tables: []config.TablePolicyInfo{{Table: "*", Verbs: []string{"GET"}}}},
+		{Role: "writer", Tables: []config.TablePolicyInfo{{Table: "crudify", Verbs: []string{"GET", "POST"}, Filters: []string{"owner = {user}"}}}},
+		{Role: "*", Tables: []config.TablePolicyInfo{{Table: "public"}}},
+	}
+
+	tests := []struct {
+		name  string
+		role  string
+		table string
+		verb  string
+		want  bool
+	}{
+		{"Verb on every table", "reader", "crudify", "GET", true},
+		{"Verb not allowed", "reader", "crudify", "DELETE", false},
+		{"Table and verb", "writer", "crudify", "POST", true},
+		{"Other table", "writer", "crudify_item", "POST", false},
+		{"Every role and verb", "anonymous", "public", "DELETE", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, got := FindPolicy(policies, tt.role, tt.table, tt.verb); got != tt.want {
+				t.Errorf("FindPolicy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	policies := []config.PolicyInfo{
+		{Role: "reader", Tables: []config.TablePolicyInfo{{Table: "crudify", Verbs: []string{"GET"}, DenyColumns: []string{"admin"}, Filters: []string{"owner = {claim.sub}", "visible = true"}}}},
+	}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy, ok := dbhelper.GetPolicy(r)
+		if !ok || policy.Filters["owner"] != "42" || policy.Filters["visible"] != "true" || policy.DenyColumns[0] != "admin" {
+			t.Errorf("Authorize() policy = %v", policy)
+		}
+	})
+	jwtinfo := config.JWTInfo{Secret: "secret"}
+
+	tests := []struct {
+		name       string
+		method     string
+		claims     map[string]interface{}
+		wantStatus int
+	}{
+		{"Allowed", "GET", map[string]interface{}{"sub": "42", "role": "reader"}, http.StatusOK},
+		{"Verb not allowed", "DELETE", map[string]interface{}{"sub": "42", "role": "reader"}, http.StatusForbidden},
+		{"Missing claim", "GET", map[string]interface{}{"role": "reader"}, http.StatusForbidden},
+		{"Other role", "GET", map[string]interface{}{"sub": "42", "role": "writer"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/crudify", nil)
+			req.Header.Set("Authorization", "Bearer "+signJWT(t, HS256, "", []byte("secret"), tt.claims))
+			JWT(Authorize(inner, "crudify", policies), jwtinfo).ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Authorize() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
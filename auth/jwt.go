@@ -0,0 +1,436 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/handler"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Algorithms accepted in JWT headers
+const (
+	HS256 = "HS256"
+	RS256 = "RS256"
+	ES256 = "ES256"
+)
+
+// Setting holding the claims of a token in database transactions
+const ClaimsSetting = "request.jwt.claims"
+
+// JWTKey verifies signatures of tokens using its algorithm
+// Key is a []byte secret, a *rsa.PublicKey or an *ecdsa.PublicKey
+type JWTKey struct {
+	Kid       string
+	Algorithm string
+	Key       interface{}
+}
+
+// Keys loaded for each configuration
+var jwtKeys = map[config.JWTInfo][]JWTKey{}
+var jwtKeysMutex sync.Mutex
+
+// JWTEnabled tells if a key is configured to verify tokens
+func JWTEnabled(jwtinfo config.JWTInfo) bool {
+	return jwtinfo.Secret != "" || jwtinfo.SecretFile != "" || jwtinfo.KeyFile != "" || jwtinfo.JWKSFile != ""
+}
+
+// GetJWTKeys loads the keys of a configuration once
+func GetJWTKeys(jwtinfo config.JWTInfo) ([]JWTKey, error) {
+	jwtKeysMutex.Lock()
+	defer jwtKeysMutex.Unlock()
+	if keys, ok := jwtKeys[jwtinfo]; ok {
+		return keys, nil
+	}
+
+	var keys []JWTKey
+	if jwtinfo.Secret != "" {
+		keys = append(keys, JWTKey{Algorithm: HS256, Key: []byte(jwtinfo.Secret)})
+	}
+	if jwtinfo.SecretFile != "" {
+		secret, err := ioutil.ReadFile(jwtinfo.SecretFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, JWTKey{Algorithm: HS256, Key: []byte(strings.TrimSpace(string(secret)))})
+	}
+	if jwtinfo.KeyFile != "" {
+		content, err := ioutil.ReadFile(jwtinfo.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := ParsePEMKey(content)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if jwtinfo.JWKSFile != "" {
+		content, err := ioutil.ReadFile(jwtinfo.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		jwks, err := ParseJWKS(content)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwks...)
+	}
+	if len(keys) <= 0 {
+		return nil, errors.New("No key configured to verify tokens")
+	}
+	jwtKeys[jwtinfo] = keys
+	return keys, nil
+}
+
+// ParsePEMKey reads a RSA or ECDSA public key, or the public key of a certificate
+func ParsePEMKey(content []byte) (JWTKey, error) {
+	var key interface{}
+	var err error
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return JWTKey{}, errors.New("Key file is not PEM encoded")
+	}
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return JWTKey{}, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return JWTKey{Algorithm: RS256, Key: key}, nil
+	case *ecdsa.PublicKey:
+		return JWTKey{Algorithm: ES256, Key: key}, nil
+	}
+	return JWTKey{}, errors.New("Key file should hold a RSA or ECDSA public key")
+}
+
+// JWK is a single key of a JWKS file
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// ParseJWKS reads keys of a JWKS document, keys which are not used for signatures are skipped
+func ParseJWKS(content []byte) ([]JWTKey, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	var keys []JWTKey
+
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, err
+	}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.JWTKey()
+		if err != nil {
+			return nil, errors.New("Key " + jwk.Kid + ": " + err.Error())
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// JWTKey converts a JWK into a key verifying signatures
+func (jwk JWK) JWTKey() (JWTKey, error) {
+	switch jwk.Kty {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		return JWTKey{Kid: jwk.Kid, Algorithm: HS256, Key: secret}, nil
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		return JWTKey{Kid: jwk.Kid, Algorithm: RS256, Key: &rsa.PublicKey{N: n, E: int(e.Int64())}}, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return JWTKey{}, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return JWTKey{}, err
+		}
+		return JWTKey{Kid: jwk.Kid, Algorithm: ES256, Key: &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}}, nil
+	}
+	return JWTKey{}, errors.New("unsupported key type " + jwk.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// ParseJWT verifies the signature of a token and its registered claims, then returns its claims
+func ParseJWT(token string, keys []JWTKey, jwtinfo config.JWTInfo, now time.Time) (map[string]interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims map[string]interface{}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if err = json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if jwtinfo.Algorithm != "" && header.Alg != jwtinfo.Algorithm {
+		return nil, errors.New("unexpected algorithm " + header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	verified := false
+	for _, key := range keys {
+		if key.Algorithm != header.Alg || (header.Kid != "" && key.Kid != "" && key.Kid != header.Kid) {
+			continue
+		}
+		if verifySignature(key, parts[0]+"."+parts[1], signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	rawClaims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if err = json.Unmarshal(rawClaims, &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	return claims, ValidateClaims(claims, jwtinfo, now)
+}
+
+// Check a signature of the signed part of a token
+func verifySignature(key JWTKey, signed string, signature []byte) bool {
+	hash := sha256.Sum256([]byte(signed))
+
+	switch key.Algorithm {
+	case HS256:
+		secret, ok := key.Key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(signed))
+		return hmac.Equal(mac.Sum(nil), signature)
+	case RS256:
+		public, ok := key.Key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		return rsa.VerifyPKCS1v15(public, crypto.SHA256, hash[:], signature) == nil
+	case ES256:
+		public, ok := key.Key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(public, hash[:], r, s)
+	}
+	return false
+}
+
+// ValidateClaims checks expiration, activation, audience and issuer of a token
+func ValidateClaims(claims map[string]interface{}, jwtinfo config.JWTInfo, now time.Time) error {
+	leeway := time.Duration(jwtinfo.Leeway) * time.Second
+
+	if exp, ok := claims["exp"]; ok {
+		expNumber, ok := exp.(float64)
+		if !ok {
+			return errors.New("exp claim should be a number")
+		}
+		if now.After(time.Unix(int64(expNumber), 0).Add(leeway)) {
+			return errors.New("token is expired")
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		nbfNumber, ok := nbf.(float64)
+		if !ok {
+			return errors.New("nbf claim should be a number")
+		}
+		if now.Add(leeway).Before(time.Unix(int64(nbfNumber), 0)) {
+			return errors.New("token is not valid yet")
+		}
+	}
+	if jwtinfo.Audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == jwtinfo.Audience
+		case []interface{}:
+			for _, value := range aud {
+				if value == jwtinfo.Audience {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return errors.New("token is not intended for audience " + jwtinfo.Audience)
+		}
+	}
+	if jwtinfo.Issuer != "" && claims["iss"] != jwtinfo.Issuer {
+		return errors.New("token is not issued by " + jwtinfo.Issuer)
+	}
+	return nil
+}
+
+// GetClaims returns the claims of the token that authenticated a request
+func GetClaims(r *http.Request) map[string]interface{} {
+	if r != nil {
+		if claims, ok := r.Context().Value("claims").(map[string]interface{}); ok {
+			return claims
+		}
+	}
+	return nil
+}
+
+// GetRole returns the role claimed by a token, or the default role
+func GetRole(claims map[string]interface{}, jwtinfo config.JWTInfo) string {
+	roleClaim := jwtinfo.RoleClaim
+	if roleClaim == "" {
+		roleClaim = "role"
+	}
+	if role, ok := claims[roleClaim].(string); ok && role != "" {
+		return role
+	}
+	return jwtinfo.DefaultRole
+}
+
+// Answer a failed bearer authentication with a challenge
+func sendBearerError(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Log(r).Warn().Msg(err.Error())
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	err = handler.SendAnswer(w, r, nil, err)
+	if err != nil {
+		logger.Log(r).Warn().Msg(err.Error())
+	}
+}
+
+// JWT authenticates requests with a bearer token, its claims are stored in the request context
+// With SetRole, database transactions of the request run with the role and the claims of the token
+func JWT(inner http.Handler, jwtinfo config.JWTInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+		logger.Log(r).Debug().Msg("Verifying bearer token")
+
+		auth := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+		if len(auth) != 2 || auth[0] != "Bearer" {
+			sendBearerError(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Authorization failed : not a bearer token"))
+			return
+		}
+
+		keys, err := GetJWTKeys(jwtinfo)
+		if err != nil {
+			logger.Log(r).Error().Msg(err.Error())
+			err = handler.SendAnswer(w, r, nil, err)
+			if err != nil {
+				logger.Log(r).Warn().Msg(err.Error())
+			}
+			return
+		}
+
+		claims, err := ParseJWT(strings.TrimSpace(auth[1]), keys, jwtinfo, time.Now())
+		if err != nil {
+			sendBearerError(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Authorization failed : "+err.Error()))
+			return
+		}
+
+		role := GetRole(claims, jwtinfo)
+		ctx := context.WithValue(r.Context(), "claims", claims)
+		r = r.WithContext(context.WithValue(ctx, "role", role))
+		if jwtinfo.SetRole {
+			// Without a role, transactions would run with the privileges of the connection user
+			if role == "" {
+				err = apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Authorization failed : token has no role and no default role is set")
+				logger.Log(r).Warn().Msg(err.Error())
+				err = handler.SendAnswer(w, r, nil, err)
+				if err != nil {
+					logger.Log(r).Warn().Msg(err.Error())
+				}
+				return
+			}
+			rawClaims, err := json.Marshal(claims)
+			if err != nil {
+				sendBearerError(w, r, apierror.New(http.StatusUnauthorized, apierror.CodeUnauthorized, "Authorization failed : "+err.Error()))
+				return
+			}
+			r = dbhelper.WithSession(r, dbhelper.Session{
+				Role:     role,
+				Settings: map[string]string{ClaimsSetting: string(rawClaims)},
+			})
+		}
+
+		inner.ServeHTTP(w, r)
+	})
+}
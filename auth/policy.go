@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/handler"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Role of requests which are not authenticated
+const AnonymousRole = "anonymous"
+
+// Role of requests authenticated by an API key
+const APIKeyRole = "apikey"
+
+// GetRequestRole returns the role of the user, token or key that authenticated a request
+func GetRequestRole(r *http.Request) string {
+	if r != nil {
+		if role, ok := r.Context().Value("role").(string); ok && role != "" {
+			return role
+		}
+	}
+	return AnonymousRole
+}
+
+// FindPolicy returns the first policy of a role, or of every role with "*", allowing a verb on a table
+// Tables may be "*", and empty verbs allow every verb
+func FindPolicy(policies []config.PolicyInfo, role string, tablename string, verb string) (config.TablePolicyInfo, bool) {
+	for _, policy := range policies {
+		if policy.Role != role && policy.Role != "*" {
+			continue
+		}
+		for _, tablePolicy := range policy.Tables {
+			if tablePolicy.Table != tablename && tablePolicy.Table != "*" {
+				continue
+			}
+			if len(tablePolicy.Verbs) <= 0 {
+				return tablePolicy, true
+			}
+			for _, myverb := range tablePolicy.Verbs {
+				if myverb == "*" || strings.EqualFold(myverb, verb) {
+					return tablePolicy, true
+				}
+			}
+		}
+	}
+	return config.TablePolicyInfo{}, false
+}
+
+// ResolveFilters converts filters like "owner_id = {claim.sub}" into the value each column should hold
+// Values may be literals, {claim.name}, {user}, {apikey} or {role}
+func ResolveFilters(r *http.Request, filters []string) (map[string]string, error) {
+	resolved := map[string]string{}
+
+	for _, filter := range filters {
+		pair := strings.SplitN(filter, "=", 2)
+		if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" {
+			return nil, apierror.New(http.StatusInternalServerError, apierror.CodeInternal, "Policy filter not recognised: "+filter)
+		}
+		column := strings.TrimSpace(pair[0])
+		value := strings.TrimSpace(pair[1])
+
+		switch {
+		case strings.HasPrefix(value, "{claim.") && strings.HasSuffix(value, "}"):
+			name := value[len("{claim.") : len(value)-1]
+			claim, ok := GetClaims(r)[name]
+			if !ok || claim == nil {
+				return nil, apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Policy needs claim "+name)
+			}
+			value = fmt.Sprintf("%v", claim)
+		case value == "{user}":
+			if value = GetUsername(r); value == "" {
+				return nil, apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Policy needs an authenticated user")
+			}
+		case value == "{apikey}":
+			if value = GetAPIKeyID(r); value == "" {
+				return nil, apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Policy needs an API key")
+			}
+		case value == "{role}":
+			value = GetRequestRole(r)
+		}
+		resolved[column] = value
+	}
+	return resolved, nil
+}
+
+// Resolve the policy of the role of a request allowing a verb on a table, nested tables resolve their own policy
+func resolvePolicy(r *http.Request, policies []config.PolicyInfo, tablename string, verb string) (dbhelper.Policy, error) {
+	role := GetRequestRole(r)
+	tablePolicy, ok := FindPolicy(policies, role, tablename, verb)
+	if !ok {
+		return dbhelper.Policy{}, apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Role "+role+" is not allowed to "+verb+" on "+tablename)
+	}
+	filters, err := ResolveFilters(r, tablePolicy.Filters)
+	if err != nil {
+		return dbhelper.Policy{}, err
+	}
+	return dbhelper.Policy{
+		Table:       tablename,
+		Columns:     tablePolicy.Columns,
+		DenyColumns: tablePolicy.DenyColumns,
+		Filters:     filters,
+		Nested: func(r *http.Request, nestedtable string, verb string) (dbhelper.Policy, error) {
+			return resolvePolicy(r, policies, nestedtable, verb)
+		},
+	}, nil
+}
+
+// Authorize allows a verb on a table only when a policy of the role of the request allows it
+// Columns and mandatory filters of the policy are enforced when querying the database
+func Authorize(inner http.Handler, tablename string, policies []config.PolicyInfo) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.Log(r).Debug().Msg("Authorizing role " + GetRequestRole(r) + " to " + r.Method + " on " + tablename)
+
+		policy, err := resolvePolicy(r, policies, tablename, r.Method)
+		if err != nil {
+			logger.Log(r).Warn().Msg(err.Error())
+			err = handler.SendAnswer(w, r, nil, err)
+			if err != nil {
+				logger.Log(r).Warn().Msg(err.Error())
+			}
+			return
+		}
+
+		inner.ServeHTTP(w, dbhelper.WithPolicy(r, policy))
+	})
+}
@@ -0,0 +1,384 @@
+package changes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Channel notified with the id of every change
+const Channel = "crudify_changes"
+
+// Table logging changes, from which clients resume
+const LogTable = "crudify_change"
+
+// Changes read at once, a client resuming further behind receives them in several reads
+var ReplayLimit = 1000
+
+// Ids are taken before transactions commit, so a change may be committed after changes with greater ids
+// Changes within this many ids behind the latest are read again, and those not broadcast yet are broadcast
+var ReorderWindow int64 = 100
+
+// Change is a row inserted, updated or deleted in a table, its id increases with every change
+type Change struct {
+	ID        int64                  `json:"id"`
+	Table     string                 `json:"table"`
+	Operation string                 `json:"operation"`
+	Row       map[string]interface{} `json:"row"`
+	Time      time.Time              `json:"time"`
+}
+
+func errNotConnected() error {
+	return apierror.New(http.StatusServiceUnavailable, apierror.CodeNotConnected, "Not connected to database")
+}
+
+// InstallSQL returns the statements creating the log table, the trigger function and triggers on tables
+// Triggers log the new row, or the old one on delete, without the hidden columns of the table and notify its id
+func InstallSQL(tables []string) []string {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS ` + LogTable + ` (
+	id bigserial PRIMARY KEY,
+	table_name text NOT NULL,
+	operation text NOT NULL,
+	row_data jsonb NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+)`,
+		`CREATE OR REPLACE FUNCTION ` + LogTable + `_notify() RETURNS trigger AS $$
+DECLARE
+	changed jsonb;
+	change_id bigint;
+BEGIN
+	IF TG_OP = 'DELETE' THEN
+		changed := to_jsonb(OLD);
+	ELSE
+		changed := to_jsonb(NEW);
+	END IF;
+	IF TG_NARGS > 0 THEN
+		changed := changed - TG_ARGV;
+	END IF;
+	INSERT INTO ` + LogTable + ` (table_name, operation, row_data) VALUES (TG_TABLE_NAME, lower(TG_OP), changed)
+		RETURNING id INTO change_id;
+	PERFORM pg_notify('` + Channel + `', change_id::text);
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql`,
+	}
+	for _, table := range tables {
+		if table == LogTable {
+			continue
+		}
+		quoted := pq.QuoteIdentifier(table)
+		var hidden []string
+		if mask := dbhelper.GetMask(table); mask != nil {
+			for _, column := range mask.Hidden {
+				hidden = append(hidden, pq.QuoteLiteral(column))
+			}
+		}
+		statements = append(statements,
+			`DROP TRIGGER IF EXISTS `+LogTable+` ON `+quoted,
+			`CREATE TRIGGER `+LogTable+` AFTER INSERT OR UPDATE OR DELETE ON `+quoted+
+				` FOR EACH ROW EXECUTE PROCEDURE `+LogTable+`_notify(`+strings.Join(hidden, ", ")+`)`,
+		)
+	}
+	return statements
+}
+
+// Install creates the log table and the triggers notifying changes of tables
+func Install(tables []string) error {
+	if dbhelper.GetConnection() == nil {
+		return errNotConnected()
+	}
+	logger.Log(nil).Info().Msg("Installing change triggers on " + strings.Join(tables, ", "))
+	for _, statement := range InstallSQL(tables) {
+		if _, err := dbhelper.GetConnection().DB.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune removes changes older than retention
+func Prune(retention time.Duration) error {
+	if dbhelper.GetConnection() == nil {
+		return errNotConnected()
+	}
+	_, err := dbhelper.GetConnection().DB.Exec(`DELETE FROM `+LogTable+` WHERE created_at < $1`, time.Now().Add(-retention))
+	return err
+}
+
+// Since returns at most ReplayLimit changes of a table, or of every table when empty, following lastID
+func Since(table string, lastID int64) ([]Change, error) {
+	var changes []Change
+
+	if dbhelper.GetConnection() == nil {
+		return nil, errNotConnected()
+	}
+	rows, err := dbhelper.GetConnection().DB.Query(`SELECT id, table_name, operation, row_data, created_at FROM `+LogTable+
+		` WHERE id > $1 AND ($2 = '' OR table_name = $2) ORDER BY id LIMIT $3`, lastID, table, ReplayLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var change Change
+		var data []byte
+		if err = rows.Scan(&change.ID, &change.Table, &change.Operation, &data, &change.Time); err != nil {
+			return nil, err
+		}
+		// Numbers are kept as written so that they match filters
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err = decoder.Decode(&change.Row); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+// Read every change of a table following lastID, ReplayLimit at a time, until handle fails
+func readSince(table string, lastID int64, handle func(change Change) error) error {
+	for {
+		changes, err := Since(table, lastID)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			if err = handle(change); err != nil {
+				return err
+			}
+			lastID = change.ID
+		}
+		if len(changes) < ReplayLimit {
+			return nil
+		}
+	}
+}
+
+// LastID returns the id of the latest change
+func LastID() (int64, error) {
+	var lastID int64
+
+	if dbhelper.GetConnection() == nil {
+		return 0, errNotConnected()
+	}
+	err := dbhelper.GetConnection().DB.QueryRow(`SELECT coalesce(max(id), 0) FROM ` + LogTable).Scan(&lastID)
+	return lastID, err
+}
+
+// Matches tells if the row of a change holds every filtered value
+func Matches(change Change, filters map[string]string) bool {
+	for key, value := range filters {
+		if field, ok := change.Row[key]; !ok || fmt.Sprintf("%v", field) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Ids of changes already handled, those further than ReorderWindow behind the latest are taken as handled
+type seenIDs struct {
+	last int64
+	ids  map[int64]bool
+}
+
+func newSeenIDs(last int64) *seenIDs {
+	return &seenIDs{last: last, ids: map[int64]bool{}}
+}
+
+// Tell if an id was handled
+func (s *seenIDs) has(id int64) bool {
+	return id <= s.last-ReorderWindow || s.ids[id]
+}
+
+// Record an id, false when it was already handled
+func (s *seenIDs) add(id int64) bool {
+	if s.has(id) {
+		return false
+	}
+	s.ids[id] = true
+	if id > s.last {
+		s.last = id
+		for seen := range s.ids {
+			if seen <= s.last-ReorderWindow {
+				delete(s.ids, seen)
+			}
+		}
+	}
+	return true
+}
+
+// Id following which changes may not have been handled yet
+func (s *seenIDs) from() int64 {
+	if s.last <= ReorderWindow {
+		return 0
+	}
+	return s.last - ReorderWindow
+}
+
+// Hub broadcasts changes of the database to subscribers of their table
+type Hub struct {
+	mutex       sync.RWMutex
+	subscribers map[chan Change]string
+	seen        *seenIDs
+	closed      bool
+}
+
+// Changes buffered for a subscriber, a subscriber too slow to read them is dropped
+const subscriberBuffer = 256
+
+// NewHub creates a hub without subscribers, fed by Listen
+func NewHub() *Hub {
+	return &Hub{subscribers: map[chan Change]string{}, seen: newSeenIDs(0)}
+}
+
+// Subscribe returns a channel receiving changes of a table and a function unsubscribing it
+// The channel is closed when the hub stops or the subscriber lags behind
+func (h *Hub) Subscribe(table string) (chan Change, func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	subscriber := make(chan Change, subscriberBuffer)
+	if h.closed {
+		close(subscriber)
+		return subscriber, func() {}
+	}
+	h.subscribers[subscriber] = table
+	return subscriber, func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		if _, ok := h.subscribers[subscriber]; ok {
+			delete(h.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Broadcast sends a change to subscribers of its table, once
+func (h *Hub) Broadcast(change Change) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if !h.seen.add(change.ID) {
+		return
+	}
+	for subscriber, table := range h.subscribers {
+		if table != change.Table {
+			continue
+		}
+		select {
+		case subscriber <- change:
+		default:
+			logger.Log(nil).Warn().Msg("Dropping slow subscriber of changes on " + table)
+			delete(h.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// Close disconnects every subscriber
+func (h *Hub) Close() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.closed = true
+	for subscriber := range h.subscribers {
+		delete(h.subscribers, subscriber)
+		close(subscriber)
+	}
+}
+
+// Broadcast changes not broadcast yet, committed late or missed while notifications were not received
+func (h *Hub) catchUp() error {
+	h.mutex.RLock()
+	from := h.seen.from()
+	h.mutex.RUnlock()
+
+	return readSince("", from, func(change Change) error {
+		h.Broadcast(change)
+		return nil
+	})
+}
+
+// Listen broadcasts changes notified by the database until ctx is done, then disconnects subscribers
+// Changes are pruned hourly when a retention is configured
+func (h *Hub) Listen(ctx context.Context, dbinfo config.DBInfo, changesinfo config.ChangesInfo) error {
+	defer h.Close()
+
+	listener := pq.NewListener(dbhelper.FormatSettings(dbinfo), 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Log(nil).Warn().Msg("Change listener: " + err.Error())
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(Channel); err != nil {
+		return err
+	}
+	lastID, err := LastID()
+	if err != nil {
+		return err
+	}
+	// Changes logged before listening are not broadcast
+	seen := newSeenIDs(lastID)
+	err = readSince("", seen.from(), func(change Change) error {
+		seen.add(change.ID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	h.seen = seen
+	h.mutex.Unlock()
+
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-prune.C:
+			if changesinfo.Retention > 0 {
+				if err := Prune(time.Duration(changesinfo.Retention) * time.Hour); err != nil {
+					logger.Log(nil).Warn().Msg("Cannot prune changes: " + err.Error())
+				}
+			}
+		case notification := <-listener.Notify:
+			// A nil notification follows a reconnection, notifications may have been missed meanwhile
+			if notification == nil {
+				if err := h.catchUp(); err != nil {
+					logger.Log(nil).Warn().Msg("Cannot read missed changes: " + err.Error())
+				}
+				continue
+			}
+			id, err := strconv.ParseInt(notification.Extra, 10, 64)
+			if err != nil {
+				continue
+			}
+			h.mutex.RLock()
+			broadcast := h.seen.has(id)
+			h.mutex.RUnlock()
+			if broadcast {
+				continue
+			}
+			// Read every change up to the notified one, in order, along with those committed late
+			if err := h.catchUp(); err != nil {
+				logger.Log(nil).Warn().Msg("Cannot read change " + notification.Extra + ": " + err.Error())
+			}
+		}
+	}
+}
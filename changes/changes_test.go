@@ -0,0 +1,322 @@
+package changes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
+)
+
+func TestMatches(t *testing.T) {
+	change := Change{Table: "orders", Row: map[string]interface{}{"id": json.Number("42"), "status": "paid", "note": nil}}
+
+	tests := []struct {
+		name    string
+		filters map[string]string
+		want    bool
+	}{
+		{"no filter", map[string]string{}, true},
+		{"string", map[string]string{"status": "paid"}, true},
+		{"number", map[string]string{"id": "42", "status": "paid"}, true},
+		{"other value", map[string]string{"status": "pending"}, false},
+		{"missing column", map[string]string{"customer": "1"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Matches(change, tt.filters); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInstallSQL(t *testing.T) {
+	dbhelper.Masks = []config.MaskInfo{{Table: "orders", Hidden: []string{"secret", "it's"}}}
+	defer func() { dbhelper.Masks = nil }()
+
+	statements := InstallSQL([]string{"orders", LogTable, `odd"name`})
+	if len(statements) != 6 {
+		t.Fatalf("InstallSQL() = %v statements, want 6", len(statements))
+	}
+	if !strings.Contains(statements[0], "CREATE TABLE IF NOT EXISTS "+LogTable) {
+		t.Errorf("InstallSQL() log table = %v", statements[0])
+	}
+	if !strings.Contains(statements[1], "pg_notify('"+Channel+"'") {
+		t.Errorf("InstallSQL() function = %v", statements[1])
+	}
+	if !strings.Contains(statements[3], `ON "orders" FOR EACH ROW`) || !strings.Contains(statements[5], `ON "odd""name"`) {
+		t.Errorf("InstallSQL() triggers = %v", statements[2:])
+	}
+	if !strings.HasSuffix(statements[3], `_notify('secret', 'it''s')`) || !strings.HasSuffix(statements[5], "_notify()") {
+		t.Errorf("InstallSQL() hidden columns = %v", statements[2:])
+	}
+}
+
+func TestSeenIDs(t *testing.T) {
+	defer func(window int64) { ReorderWindow = window }(ReorderWindow)
+	ReorderWindow = 10
+
+	seen := newSeenIDs(100)
+	tests := []struct {
+		name string
+		id   int64
+		want bool
+	}{
+		{"following", 101, true},
+		{"again", 101, false},
+		{"committed late", 95, true},
+		{"too far behind", 90, false},
+		{"ahead", 120, true},
+		{"behind the new latest", 105, false},
+		{"late behind the new latest", 115, true},
+	}
+	for _, tt := range tests {
+		if got := seen.add(tt.id); got != tt.want {
+			t.Errorf("%v: add(%v) = %v, want %v", tt.name, tt.id, got, tt.want)
+		}
+	}
+	if seen.from() != 110 || len(seen.ids) != 2 {
+		t.Errorf("from() = %v with %v ids, want 110 with 2 ids", seen.from(), len(seen.ids))
+	}
+}
+
+func TestHub(t *testing.T) {
+	hub := NewHub()
+	orders, unsubscribe := hub.Subscribe("orders")
+	customers, _ := hub.Subscribe("customers")
+
+	hub.Broadcast(Change{ID: 1, Table: "customers"})
+	hub.Broadcast(Change{ID: 3, Table: "orders"})
+	hub.Broadcast(Change{ID: 3, Table: "orders"})
+	hub.Broadcast(Change{ID: 2, Table: "orders"})
+	if change := <-orders; change.ID != 3 {
+		t.Errorf("Subscribe() received change %v, want 3", change.ID)
+	}
+	if change := <-orders; change.ID != 2 {
+		t.Errorf("Subscribe() received change %v, want the change committed late 2", change.ID)
+	}
+	if len(orders) != 0 {
+		t.Errorf("Broadcast() sent a change twice")
+	}
+	if change := <-customers; change.ID != 1 {
+		t.Errorf("Subscribe() received change %v, want 1", change.ID)
+	}
+
+	unsubscribe()
+	if _, ok := <-orders; ok {
+		t.Error("unsubscribe() did not close the channel")
+	}
+	hub.Close()
+	if _, ok := <-customers; ok {
+		t.Error("Close() did not close subscribers")
+	}
+	if _, ok := <-func() chan Change { c, _ := hub.Subscribe("orders"); return c }(); ok {
+		t.Error("Subscribe() to a closed hub returned an open channel")
+	}
+}
+
+// Wait for a stream to subscribe to the hub
+func waitSubscribers(t *testing.T, hub *Hub, count int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		hub.mutex.RLock()
+		subscribers := len(hub.subscribers)
+		hub.mutex.RUnlock()
+		if subscribers >= count {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Stream did not subscribe to the hub")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	hub := NewHub()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hub.Serve(r, NewEventStream(w, r), "orders", map[string]string{"status": "paid"}, 0)
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("NewEventStream() content type = %v", resp.Header.Get("Content-Type"))
+	}
+
+	waitSubscribers(t, hub, 1)
+	hub.Broadcast(Change{ID: 1, Table: "orders", Operation: "insert", Row: map[string]interface{}{"status": "pending"}})
+	hub.Broadcast(Change{ID: 2, Table: "orders", Operation: "update", Row: map[string]interface{}{"status": "paid"}})
+
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	if lines[0] != "id: 2" || lines[1] != "event: update" || !strings.Contains(lines[2], `"status":"paid"`) {
+		t.Errorf("EventStream sent %v", lines)
+	}
+}
+
+// Write a masked frame, as clients do
+func writeClientFrame(conn net.Conn, opcode byte, payload []byte) error {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+// Read an unmasked frame, as servers send them
+func readServerFrame(reader *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		var extended [2]byte
+		if _, err := io.ReadFull(reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = int(binary.BigEndian.Uint16(extended[:]))
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(reader, payload)
+	return header[0] & 0x0F, payload, err
+}
+
+func TestWebSocket(t *testing.T) {
+	hub := NewHub()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !IsWebSocket(r) {
+			t.Error("IsWebSocket() = false")
+		}
+		ws, err := Upgrade(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer ws.Close()
+		hub.Serve(r, ws, "orders", map[string]string{}, 0)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Key and accept of the handshake example of RFC 6455
+	conn.Write([]byte("GET /orders/_changes HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Upgrade() answered %v %v", resp.Status, resp.Header)
+	}
+
+	waitSubscribers(t, hub, 1)
+	hub.Broadcast(Change{ID: 7, Table: "orders", Operation: "delete", Row: map[string]interface{}{"id": 3}})
+	opcode, payload, err := readServerFrame(reader)
+	if err != nil || opcode != opText {
+		t.Fatalf("WebSocket sent frame %v %v", opcode, err)
+	}
+	var change Change
+	if err = json.Unmarshal(payload, &change); err != nil || change.ID != 7 || change.Operation != "delete" {
+		t.Errorf("WebSocket sent change %s", payload)
+	}
+
+	if err = writeClientFrame(conn, opPing, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, payload, err = readServerFrame(reader); err != nil || opcode != opPong || string(payload) != "hi" {
+		t.Errorf("WebSocket answered ping with %v %s %v", opcode, payload, err)
+	}
+	if err = writeClientFrame(conn, opClose, []byte{0x03, 0xE8}); err != nil {
+		t.Fatal(err)
+	}
+	if opcode, _, err = readServerFrame(reader); err != nil || opcode != opClose {
+		t.Errorf("WebSocket answered close with %v %v", opcode, err)
+	}
+}
+
+// Stream recording changes sent
+type recordStream struct {
+	changes []Change
+}
+
+func (s *recordStream) Send(change Change) error {
+	s.changes = append(s.changes, change)
+	return nil
+}
+
+func (s *recordStream) Ping() error           { return nil }
+func (s *recordStream) Done() <-chan struct{} { return nil }
+func (s *recordStream) Close() error          { return nil }
+
+func TestSend(t *testing.T) {
+	dbhelper.Masks = []config.MaskInfo{{Table: "users", Hidden: []string{"password"}, Masked: []string{"email"}}}
+	defer func() { dbhelper.Masks = nil }()
+
+	r := httptest.NewRequest("GET", "/users/_changes", nil)
+	r = dbhelper.WithPolicy(r, dbhelper.Policy{Table: "users", DenyColumns: []string{"owner"}, Filters: map[string]string{"owner": "7"}})
+	row := func(owner string) map[string]interface{} {
+		return map[string]interface{}{"id": 1, "owner": owner, "email": "a@b.c", "password": "secret"}
+	}
+
+	stream := &recordStream{}
+	for _, change := range []Change{{ID: 1, Table: "users", Row: row("8")}, {ID: 2, Table: "users", Row: row("7")}} {
+		if err := send(r, stream, change, map[string]string{"owner": "7"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(stream.changes) != 1 || stream.changes[0].ID != 2 {
+		t.Fatalf("send() sent %v, want the change of owner 7", stream.changes)
+	}
+	got := stream.changes[0].Row
+	if _, ok := got["password"]; ok {
+		t.Errorf("send() sent hidden column: %v", got)
+	}
+	if _, ok := got["owner"]; ok {
+		t.Errorf("send() sent column denied by policy: %v", got)
+	}
+	if got["email"] != dbhelper.MaskedValue || got["id"] != 1 {
+		t.Errorf("send() sent %v", got)
+	}
+}
+
+func TestChangesGetSession(t *testing.T) {
+	r := httptest.NewRequest("GET", "/users/_changes", nil)
+	r = dbhelper.WithSession(r, dbhelper.Session{Role: "reader"})
+	w := httptest.NewRecorder()
+	NewHub().ChangesGet(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("ChangesGet() with the role of the token = %v, want %v", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,229 @@
+package changes
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/handler"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Header and argument holding the id of the last change received by a resuming client
+const (
+	LastEventIDHeader = "Last-Event-ID"
+	LastEventIDArg    = "last_event_id"
+)
+
+// Interval between two heartbeats keeping idle streams open through proxies
+var Heartbeat = 30 * time.Second
+
+// Stream sends changes to a client, over Server-Sent Events or WebSocket
+type Stream interface {
+	Send(change Change) error
+	Ping() error
+	Done() <-chan struct{}
+	Close() error
+}
+
+// EventStream sends changes as Server-Sent Events
+type EventStream struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	ctx        context.Context
+}
+
+// NewEventStream sends the headers of an event stream, without write timeout
+func NewEventStream(w http.ResponseWriter, r *http.Request) *EventStream {
+	controller := http.NewResponseController(w)
+	controller.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	controller.Flush()
+	return &EventStream{w: w, controller: controller, ctx: r.Context()}
+}
+
+// Send writes a change as an event named after its operation
+func (s *EventStream) Send(change Change) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write([]byte("id: " + strconv.FormatInt(change.ID, 10) + "\nevent: " + change.Operation + "\ndata: " + string(data) + "\n\n"))
+	if err != nil {
+		return err
+	}
+	return s.controller.Flush()
+}
+
+// Ping writes a comment, ignored by clients
+func (s *EventStream) Ping() error {
+	if _, err := s.w.Write([]byte(": heartbeat\n\n")); err != nil {
+		return err
+	}
+	return s.controller.Flush()
+}
+
+// Done is closed when the client disconnects
+func (s *EventStream) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Close ends the stream along with the request
+func (s *EventStream) Close() error {
+	return nil
+}
+
+// Get the id of the last change received from the header set by EventSource on reconnection, or else the argument
+func lastEventID(r *http.Request) (int64, error) {
+	value := r.Header.Get(LastEventIDHeader)
+	if value == "" {
+		value = r.FormValue(dbhelper.REQUEST_ARG_PREFIX + LastEventIDArg)
+	}
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || id < 0 {
+		return 0, apierror.New(http.StatusBadRequest, apierror.CodeInvalidArgument, "Last event id should be a positive integer")
+	}
+	return id, nil
+}
+
+// Get the filters of a request like GET does, along with those mandatory for its policy
+func changeFilters(r *http.Request, tablename string) (map[string]string, error) {
+	filters := map[string]string{}
+	for key, value := range handler.GetArgs(r) {
+		if !strings.HasPrefix(key, dbhelper.REQUEST_ARG_PREFIX) {
+			filters[key] = value
+		}
+	}
+	policyFilters, err := dbhelper.PolicyFilters(r, tablename, filters)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range policyFilters {
+		filters[key] = value
+	}
+	return filters, nil
+}
+
+// ChangesGet streams changes of the table of the route matching its filters, over WebSocket when asked to upgrade
+// or else Server-Sent Events. Changes following the last event id are replayed first.
+// Requests whose transactions run with the role of their token are refused, changes are read by the connection user
+// so that row level security of the role would not apply to them
+func (h *Hub) ChangesGet(w http.ResponseWriter, r *http.Request) {
+	var stream Stream
+	var filters map[string]string
+	var lastID int64
+	var err error
+
+	tablename := handler.GetTableName(r)
+	if _, ok := dbhelper.GetSession(r); ok {
+		err = apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Changes cannot be streamed with the role of the token")
+	}
+	if err == nil {
+		filters, err = changeFilters(r, tablename)
+	}
+	if err == nil {
+		lastID, err = lastEventID(r)
+	}
+	if err == nil {
+		if IsWebSocket(r) {
+			stream, err = Upgrade(w, r)
+		} else {
+			stream = NewEventStream(w, r)
+		}
+	}
+	if err != nil {
+		logger.Log(r).Warn().Msg(err.Error())
+		err = handler.SendAnswer(w, r, nil, err)
+		if err != nil {
+			logger.Log(r).Warn().Msg(err.Error())
+		}
+		return
+	}
+	defer stream.Close()
+
+	logger.Log(r).Debug().Msg("Streaming changes of " + tablename)
+	err = h.Serve(r, stream, tablename, filters, lastID)
+	if err != nil {
+		logger.Log(r).Warn().Msg(err.Error())
+	}
+}
+
+// Serve sends changes of a table matching filters to a stream until the client or the hub disconnects
+// Changes following lastID are replayed first, changes notified meanwhile are sent once
+func (h *Hub) Serve(r *http.Request, stream Stream, tablename string, filters map[string]string, lastID int64) error {
+	subscriber, unsubscribe := h.Subscribe(tablename)
+	defer unsubscribe()
+
+	seen := newSeenIDs(lastID)
+	if lastID > 0 {
+		err := readSince(tablename, lastID, func(change Change) error {
+			seen.add(change.ID)
+			return send(r, stream, change, filters)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	heartbeat := time.NewTicker(Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-stream.Done():
+			return nil
+		case <-heartbeat.C:
+			if err := stream.Ping(); err != nil {
+				return err
+			}
+		case change, ok := <-subscriber:
+			if !ok {
+				return nil
+			}
+			if !seen.add(change.ID) {
+				continue
+			}
+			if err := send(r, stream, change, filters); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Send a change matching filters, without its hidden columns nor those its policy denies and with masked ones redacted
+func send(r *http.Request, stream Stream, change Change, filters map[string]string) error {
+	row := map[string]interface{}{}
+	for key, value := range change.Row {
+		if !dbhelper.IsHidden(change.Table, key) {
+			row[key] = value
+		}
+	}
+	change.Row = row
+	// Mandatory filters of the policy may use columns it denies
+	if !Matches(change, filters) {
+		return nil
+	}
+	if policy, ok := dbhelper.GetPolicy(r); ok {
+		for key := range row {
+			if !policy.Allows(key) {
+				delete(row, key)
+			}
+		}
+	}
+	dbhelper.MaskRow(r, change.Table, row)
+	return stream.Send(change)
+}
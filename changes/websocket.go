@@ -0,0 +1,210 @@
+package changes
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/maxime1907/crudify/apierror"
+)
+
+// GUID appended to the key of a WebSocket handshake, RFC 6455
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes of WebSocket frames
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+// Largest frame read from a client, which only sends control frames
+const maxFrameSize = 1 << 16
+
+// Time given to a client to read a frame
+var WriteTimeout = 10 * time.Second
+
+// IsWebSocket tells if a request asks to upgrade to WebSocket
+func IsWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// AcceptKey returns the Sec-WebSocket-Accept answering a Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// WebSocket sends changes as JSON text messages and answers control frames of the client
+type WebSocket struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Upgrade completes the WebSocket handshake of a request and starts reading frames of the client
+func Upgrade(w http.ResponseWriter, r *http.Request) (*WebSocket, error) {
+	if r.Method != "GET" || r.Header.Get("Sec-WebSocket-Version") != "13" || r.Header.Get("Sec-WebSocket-Key") == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, apierror.New(http.StatusBadRequest, apierror.CodeInvalidArgument, "WebSocket handshake should be a GET of version 13 with a key")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, apierror.New(http.StatusBadRequest, apierror.CodeInvalidArgument, "WebSocket needs HTTP/1.1")
+	}
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	ws := &WebSocket{conn: conn, reader: buffer.Reader, done: make(chan struct{})}
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go ws.read()
+	return ws, nil
+}
+
+// Write an unmasked frame, servers never mask them
+func (ws *WebSocket) write(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	ws.mutex.Lock()
+	defer ws.mutex.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	if _, err := ws.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Read a frame of the client, which is always masked
+func (ws *WebSocket) readFrame() (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("WebSocket frame of the client is not masked")
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(ws.reader, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > maxFrameSize {
+		return 0, nil, errors.New("WebSocket frame of the client is too large")
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.reader, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+// Answer pings and close frames of the client until it disconnects, other messages are ignored
+func (ws *WebSocket) read() {
+	defer ws.finish()
+	for {
+		opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case opClose:
+			ws.write(opClose, payload)
+			return
+		case opPing:
+			if ws.write(opPong, payload) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (ws *WebSocket) finish() {
+	ws.once.Do(func() {
+		close(ws.done)
+		ws.conn.Close()
+	})
+}
+
+// Send writes a change as a JSON text message
+func (ws *WebSocket) Send(change Change) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	return ws.write(opText, data)
+}
+
+// Ping sends a ping frame, answered by the client
+func (ws *WebSocket) Ping() error {
+	return ws.write(opPing, nil)
+}
+
+// Done is closed when the client disconnects
+func (ws *WebSocket) Done() <-chan struct{} {
+	return ws.done
+}
+
+// Close sends a normal closure frame and closes the connection
+func (ws *WebSocket) Close() error {
+	select {
+	case <-ws.done:
+	default:
+		ws.write(opClose, []byte{0x03, 0xE8})
+	}
+	ws.finish()
+	return nil
+}
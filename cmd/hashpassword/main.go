@@ -0,0 +1,40 @@
+// Command hashpassword prints the bcrypt hash of a password, to configure basic auth users
+//
+//	hashpassword mypassword
+//	echo mypassword | hashpassword
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/maxime1907/crudify/handler"
+)
+
+func main() {
+	var password string
+
+	if len(os.Args) > 1 {
+		password = os.Args[1]
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			fmt.Fprintln(os.Stderr, "Usage: hashpassword <password>, or the password on standard input")
+			os.Exit(1)
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if password == "" {
+		fmt.Fprintln(os.Stderr, "Password should not be empty")
+		os.Exit(1)
+	}
+
+	hash, err := handler.HashAndSalt(password)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(hash)
+}
@@ -14,15 +14,87 @@ type DBInfo struct {
 	Driver   string
 }
 
+type JWTInfo struct {
+	Algorithm   string
+	Secret      string
+	SecretFile  string
+	KeyFile     string
+	JWKSFile    string
+	Audience    string
+	Issuer      string
+	Leeway      int
+	RoleClaim   string
+	DefaultRole string
+	SetRole     bool
+}
+
+type UserInfo struct {
+	Username string
+	Hash     string
+	Role     string
+}
+
+type TablePolicyInfo struct {
+	Table       string
+	Verbs       []string
+	Columns     []string
+	DenyColumns []string
+	Filters     []string
+}
+
+type PolicyInfo struct {
+	Role   string
+	Tables []TablePolicyInfo
+}
+
+type APIKeyInfo struct {
+	Table string
+}
+
 type RouterInfo struct {
 	Username string
 	Password string
+	Users []UserInfo
+	UsersTable string
 	Port int
+	JWT JWTInfo
+	APIKeys APIKeyInfo
+	Policies []PolicyInfo
+	RateLimits []RateLimitInfo
+	H2C bool
+	Timeouts TimeoutInfo
+	Metrics MetricsInfo
+}
+
+// MetricsInfo serves Prometheus metrics on Path, /metrics when empty
+type MetricsInfo struct {
+	Enabled bool
+	Path    string
+}
+
+// TimeoutInfo holds server timeouts in seconds, zero means no timeout except for Shutdown which defaults to 30 seconds
+type TimeoutInfo struct {
+	Read     int
+	Write    int
+	Idle     int
+	Shutdown int
+}
+
+// RateLimitInfo configures a token bucket refilled with Rate tokens per second and holding at most Burst tokens
+// Route restricts it to a route name, Per is "identity" for a bucket per client, "ip" for a bucket per IP address
+// counted before authentication or "global" for a shared one
+type RateLimitInfo struct {
+	Route string
+	Per   string
+	Rate  float64
+	Burst int
 }
 
 type UpdaterInfo struct {
-	Url      string
-	Interval int
+	Url       string
+	Interval  int
+	PublicKey string
+	DryRun    bool
 }
 
 type CORSInfo struct {
@@ -32,15 +104,80 @@ type CORSInfo struct {
 }
 
 type TLSInfo struct {
-	Crt string
-	Key string
+	Crt          string
+	Key          string
+	ClientCA     string
+	RedirectPort int
+	Profile      string
 }
 
 type SMTPInfo struct {
 	OwnerEmail string
+	Username string
 	Password string
 	Host string
 	Port int
+	Security string
+	Retries int
+}
+
+// NotificationInfo sends an email rendered from templates when rows of a table are written
+// Operations are insert, update or delete, every operation when empty
+type NotificationInfo struct {
+	Table      string
+	Operations []string
+	To         []string
+	Subject    string
+	Text       string
+	HTML       string
+}
+
+// WebhookInfo subscribes a URL to writes on a table, every operation when Operations is empty
+type WebhookInfo struct {
+	Table      string
+	Operations []string
+	Url        string
+	Secret     string
+}
+
+// WebhooksInfo configures webhook subscriptions, their delivery and the table recording failed deliveries
+type WebhooksInfo struct {
+	Subscriptions   []WebhookInfo
+	Retries         int
+	Timeout         int
+	DeadLetterTable string
+	AdminRole       string
+}
+
+// ChangesInfo serves the change feed of tables, Install creates the log table and triggers feeding it
+// Changes older than Retention hours are pruned, never when zero
+type ChangesInfo struct {
+	Enabled   bool
+	Install   bool
+	Retention int
+}
+
+// TracingInfo traces requests and queries, exporting spans to the OTLP/HTTP Endpoint of a collector when set
+// Statements adds the text of SQL statements to spans of queries
+type TracingInfo struct {
+	Enabled     bool
+	Endpoint    string
+	ServiceName string
+	Statements  bool
+}
+
+type ResponseInfo struct {
+	Problem     bool
+	ProblemType string
+	Bare        bool
+}
+
+type MaskInfo struct {
+	Table      string
+	Hidden     []string
+	ReadOnly   []string
+	Masked     []string
+	Privileged []string
 }
 
 type Config struct {
@@ -50,6 +187,12 @@ type Config struct {
 	Cors		CORSInfo
 	TLS			TLSInfo
 	SMTP		SMTPInfo
+	Response	ResponseInfo
+	Masks		[]MaskInfo
+	Notifications	[]NotificationInfo
+	Webhooks	WebhooksInfo
+	Changes		ChangesInfo
+	Tracing		TracingInfo
 }
 
 var config Config
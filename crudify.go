@@ -1,34 +1,255 @@
 package crudify
 
 import (
+	"context"
 	"errors"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
 
+	"github.com/maxime1907/crudify/changes"
 	"github.com/maxime1907/crudify/config"
 	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/handler"
+	"github.com/maxime1907/crudify/logger"
+	"github.com/maxime1907/crudify/notify"
 	"github.com/maxime1907/crudify/router"
+	"github.com/maxime1907/crudify/tracing"
+	"github.com/maxime1907/crudify/updater"
+	"github.com/maxime1907/crudify/webhook"
 )
 
-// Run server with connection to database
+// Hooks let embedding applications act when the server starts and after it shut down
+// OnStart is called once the server listens, an error stops it
+// OnShutdown is called once in-flight requests finished, before the database is closed
+type Hooks struct {
+	OnStart    func(srv *http.Server) error
+	OnShutdown func(ctx context.Context) error
+}
+
+// Run server with connection to database, until SIGINT or SIGTERM
 func Run(l net.Listener, myconfig *config.Config, routes *[]router.Route, enableCORS bool) error {
-	var handler http.Handler
+	return RunContext(context.Background(), l, myconfig, routes, enableCORS, Hooks{})
+}
+
+// RunContext runs server with connection to database until ctx is done, SIGINT or SIGTERM
+// It then drains in-flight requests for the configured shutdown timeout, waits for background workers and closes the database
+// When updates are configured, it also stops once an updated executable took over its listener
+func RunContext(ctx context.Context, l net.Listener, myconfig *config.Config, routes *[]router.Route, enableCORS bool, hooks Hooks) error {
+	var myhandler http.Handler
 
 	if myconfig == nil {
 		return errors.New("Configuration is not set")
 	}
+	handler.Responses = myconfig.Response
+	dbhelper.Masks = myconfig.Masks
+	dbhelper.InternalTables = []string{changes.LogTable}
 	err := dbhelper.Connect(myconfig.Database)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		err := dbhelper.Close()
+		if err != nil {
+			logger.Log(nil).Warn().Msg(err.Error())
+		}
+	}()
+	// Background workers use the database until they return, once ctx is cancelled
+	var workers sync.WaitGroup
+	defer workers.Wait()
+
+	tracing.Enabled = myconfig.Tracing.Enabled
+	tracing.Statements = myconfig.Tracing.Statements
+	if myconfig.Tracing.Enabled && myconfig.Tracing.Endpoint != "" {
+		// Spans left are sent once in-flight requests finished, before the database is closed
+		exporter := tracing.NewExporter(myconfig.Tracing)
+		tracing.DefaultExporter = exporter
+		exportCtx, stopExport := context.WithCancel(context.Background())
+		exported := make(chan struct{})
+		go func() {
+			exporter.Run(exportCtx)
+			close(exported)
+		}()
+		defer func() {
+			stopExport()
+			<-exported
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if len(myconfig.Notifications) > 0 {
+		queue := notify.NewQueue(myconfig.SMTP)
+		notifier, err := notify.NewNotifier(myconfig.Notifications, queue)
+		if err != nil {
+			return err
+		}
+		unsubscribe := dbhelper.Subscribe(notifier.Notify)
+		defer unsubscribe()
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			queue.Run(ctx)
+		}()
+	}
+	if webhook.Enabled(myconfig.Webhooks) {
+		dispatcher := webhook.NewDispatcher(myconfig.Webhooks)
+		unsubscribe := dbhelper.Subscribe(dispatcher.Notify)
+		defer unsubscribe()
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			dispatcher.Run(ctx)
+		}()
+
+		// Deliveries hold payloads of every subscribed table, they are only listed to the admin role
+		if myconfig.Webhooks.AdminRole != "" {
+			var allRoutes []router.Route
+			if routes != nil {
+				allRoutes = append(allRoutes, *routes...)
+			}
+			allRoutes = append(allRoutes, router.Route{
+				Name:        "webhook_deliveries_get",
+				Method:      "GET",
+				Pattern:     "/_webhooks/deliveries",
+				HandlerFunc: dispatcher.DeliveriesGet,
+			})
+			routes = &allRoutes
+		}
+	}
+
+	if myconfig.Changes.Enabled {
+		tables, err := dbhelper.GetTables(nil)
+		if err != nil {
+			return err
+		}
+		var names []string
+		for name := range tables {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if myconfig.Changes.Install {
+			if err = changes.Install(names); err != nil {
+				return err
+			}
+		}
+
+		hub := changes.NewHub()
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			err := hub.Listen(ctx, myconfig.Database, myconfig.Changes)
+			if err != nil {
+				logger.Log(nil).Error().Msg("Change feed stopped: " + err.Error())
+			}
+		}()
+
+		// Added before other routes so that they are not taken for items of the table
+		var allRoutes []router.Route
+		for _, name := range names {
+			allRoutes = append(allRoutes, router.Route{
+				Name:        "changes_" + name,
+				Method:      "GET",
+				Pattern:     "/" + name + "/_changes",
+				HandlerFunc: hub.ChangesGet,
+				Doc:         &router.RouteDoc{Table: name, Summary: "Stream changes of " + name + " over Server-Sent Events or WebSocket"},
+			})
+		}
+		if routes != nil {
+			allRoutes = append(allRoutes, *routes...)
+		}
+		routes = &allRoutes
+	}
+
 	myrouter := router.New(routes, true, true, myconfig.Server)
 	if enableCORS {
-		handler = router.GetCORS(myrouter, myconfig.Cors)
+		myhandler = router.GetCORS(myrouter, myconfig.Cors)
+	} else {
+		myhandler = myrouter
+	}
+
+	if l == nil {
+		l, err = updater.InheritedListener()
+		if err != nil {
+			return err
+		}
+	}
+	if l == nil {
+		l, err = net.Listen("tcp", ":"+strconv.Itoa(myconfig.Server.Port))
+		if err != nil {
+			return err
+		}
+	}
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	srv := router.NewServer(myhandler, l.Addr().String(), myconfig.Server)
+	if router.TLSEnabled(myconfig.TLS) {
+		srv.TLSConfig, err = router.TLSConfig(ctx, myconfig.TLS)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		logger.Log(nil).Info().Msg("Listening and serving on port " + port + " with TLS")
 	} else {
-		handler = myrouter
+		if myconfig.Server.H2C {
+			srv.Handler = router.H2C(myhandler)
+		}
+		logger.Log(nil).Info().Msg("Listening and serving on port " + port)
 	}
-	if l != nil {
-		return router.RunWithListener(handler, l)
+
+	if router.TLSEnabled(myconfig.TLS) && myconfig.TLS.RedirectPort > 0 {
+		redirect := router.NewServer(router.RedirectToHTTPS(port), ":"+strconv.Itoa(myconfig.TLS.RedirectPort), myconfig.Server)
+		go func() {
+			logger.Log(nil).Info().Msg("Redirecting " + redirect.Addr + " to HTTPS port " + port)
+			redirectListener, err := net.Listen("tcp", redirect.Addr)
+			if err == nil {
+				err = router.Serve(ctx, redirect, redirectListener, router.ShutdownTimeout(myconfig.Server))
+			}
+			if err != nil && err != http.ErrServerClosed {
+				logger.Log(nil).Error().Msg(err.Error())
+			}
+		}()
+	}
+
+	if updater.Enabled(myconfig.Update) {
+		executable, err := os.Executable()
+		if err != nil {
+			l.Close()
+			return err
+		}
+		go updater.Poll(ctx, myconfig.Update, executable, func() error {
+			err := updater.Restart(executable, l)
+			if err == nil {
+				cancel()
+			}
+			return err
+		})
+	}
+
+	if hooks.OnStart != nil {
+		err = hooks.OnStart(srv)
+		if err != nil {
+			l.Close()
+			return err
+		}
+	}
+
+	err = router.Serve(ctx, srv, l, router.ShutdownTimeout(myconfig.Server))
+	if hooks.OnShutdown != nil {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), router.ShutdownTimeout(myconfig.Server))
+		defer cancel()
+		hookErr := hooks.OnShutdown(shutdownCtx)
+		if hookErr != nil {
+			logger.Log(nil).Warn().Msg(hookErr.Error())
+		}
 	}
-	return router.Run(handler, myconfig.Server.Port)
+	return err
 }
@@ -1,26 +1,40 @@
 package dbhelper
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gocraft/dbr"
-	_ "github.com/lib/pq"
+	"github.com/gocraft/dbr/dialect"
+	"github.com/lib/pq"
+	"github.com/maxime1907/crudify/apierror"
 	"github.com/maxime1907/crudify/config"
 	"github.com/maxime1907/crudify/logger"
+	"github.com/maxime1907/crudify/metrics"
+	"github.com/maxime1907/crudify/tracing"
 )
 
 // Global variable that holds all table names in database
 var tables map[string]string
 
+// Tables used by crudify itself, they are left out of table names so that they are neither served nor nested
+var InternalTables []string
+
 // Global variable that holds connection to database
 var connection *dbr.Connection
 
+// Version number of the PostgreSQL server, such as 110005, zero when unknown
+var serverVersion int
+
 var REQUEST_ARG_PREFIX string = "_"
 
 type Builder struct {
@@ -29,10 +43,136 @@ type Builder struct {
 	Operand string
 }
 
+func errNotConnected() error {
+	return apierror.New(http.StatusServiceUnavailable, apierror.CodeNotConnected, "Not connected to database")
+}
+
+func invalidArgument(message string) error {
+	return apierror.New(http.StatusBadRequest, apierror.CodeInvalidArgument, message)
+}
+
+func invalidBody(message string) error {
+	return apierror.New(http.StatusBadRequest, apierror.CodeInvalidBody, message)
+}
+
+// DatabaseError converts errors returned by the database driver into an apierror.Error
+// carrying the table, column and constraint at fault, other errors are returned as is
+func DatabaseError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if err == sql.ErrNoRows {
+		return apierror.New(http.StatusNotFound, apierror.CodeNotFound, err.Error())
+	}
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return err
+	}
+
+	apiErr := apierror.New(http.StatusInternalServerError, apierror.CodeInternal, err.Error())
+	switch pqErr.Code {
+	case "23505":
+		apiErr.Status, apiErr.Code = http.StatusConflict, apierror.CodeUniqueViolation
+	case "23503":
+		apiErr.Status, apiErr.Code = http.StatusConflict, apierror.CodeForeignKeyViolation
+	case "23502":
+		apiErr.Status, apiErr.Code = http.StatusConflict, apierror.CodeNotNullViolation
+	case "23514":
+		apiErr.Status, apiErr.Code = http.StatusConflict, apierror.CodeCheckViolation
+	case "42P01":
+		apiErr.Status, apiErr.Code = http.StatusNotFound, apierror.CodeUndefinedTable
+	case "42703":
+		apiErr.Status, apiErr.Code = http.StatusBadRequest, apierror.CodeUndefinedColumn
+	default:
+		switch pqErr.Code.Class() {
+		case "22":
+			apiErr.Status, apiErr.Code = http.StatusBadRequest, apierror.CodeInvalidValue
+		case "23":
+			apiErr.Status, apiErr.Code = http.StatusConflict, apierror.CodeConflict
+		}
+	}
+	apiErr.Table = pqErr.Table
+	apiErr.Column = pqErr.Column
+	apiErr.Constraint = pqErr.Constraint
+	if pqErr.Detail != "" {
+		apiErr.Details = pqErr.Detail
+	}
+	return apiErr
+}
+
 func GetConnection() *dbr.Connection {
 	return connection
 }
 
+// Generic query on a table, traced and measured
+type tableQuery struct {
+	span      *tracing.Span
+	tablename string
+	operation string
+	start     time.Time
+	rows      int64
+}
+
+// Start a generic query, the request returned carries its span to the queries it runs
+func startQuery(r *http.Request, tablename string, operation string) (*http.Request, *tableQuery) {
+	q := &tableQuery{tablename: tablename, operation: operation, start: time.Now(), rows: -1}
+
+	var ctx context.Context = context.Background()
+	if r != nil {
+		ctx = r.Context()
+	}
+	ctx, q.span = tracing.Start(ctx, operation+" "+tablename, tracing.KindClient)
+	q.span.SetAttribute("db.system", "postgresql")
+	q.span.SetAttribute("db.sql.table", tablename)
+	q.span.SetAttribute("db.operation", operation)
+	if r != nil && q.span != nil {
+		r = r.WithContext(ctx)
+	}
+	return r, q
+}
+
+// End a query with its error, along with the rows it read or wrote when they were counted
+func (q *tableQuery) end(err error) {
+	metrics.QueryDuration.Observe(time.Since(q.start).Seconds(), q.tablename, q.operation)
+	if q.rows >= 0 {
+		q.span.SetAttribute("db.rows", q.rows)
+	}
+	q.span.Finish(err)
+}
+
+// Count rows read or written by the query
+func (q *tableQuery) count(nb int64) {
+	if q.rows < 0 {
+		q.rows = 0
+	}
+	q.rows += nb
+}
+
+// Count rows affected by a statement
+func (q *tableQuery) affected(result sql.Result) {
+	if nb, err := result.RowsAffected(); err == nil {
+		q.count(nb)
+	}
+}
+
+// Add the text of a statement to the span of the query of a request, when statements are traced
+func traceStatement(r *http.Request, statement string) {
+	if r != nil && tracing.Statements {
+		tracing.FromContext(r.Context()).SetAttribute("db.statement", statement)
+	}
+}
+
+// Add the text of a statement built by dbr, with its placeholders, when statements are traced
+func traceBuilder(r *http.Request, builder dbr.Builder) {
+	if r == nil || !tracing.Statements || connection == nil {
+		return
+	}
+	buf := dbr.NewBuffer()
+	if builder.Build(connection.Dialect, buf) == nil {
+		traceStatement(r, buf.String())
+	}
+}
+
 // Get tables from sql database
 func GetTables(r *http.Request) (map[string]string, error) {
 	logger.Log(r).Debug().Msg("Getting table names from database")
@@ -46,8 +186,12 @@ func GetTables(r *http.Request) (map[string]string, error) {
 		if size > 0 {
 			tables = map[string]string{}
 			for i := 0; i < size; i++ {
-				tables[(*res)[i]["table_name"].(string)] = (*res)[i]["table_name"].(string)
+				name := (*res)[i]["table_name"].(string)
+				if !containsString(InternalTables, name) {
+					tables[name] = name
+				}
 			}
+			metrics.SchemaReloads.Inc("tables")
 		} else {
 			return nil, errors.New("Database does not contain any table OR you do not have proper rights to access it")
 		}
@@ -90,13 +234,37 @@ func Connect(configuration config.DBInfo) error {
 	if err != nil {
 		return err
 	}
+	metrics.Pool.Set(connection.DB)
+	serverVersion = 0
+	if connection.Dialect == dialect.PostgreSQL {
+		var version string
+		err = connection.DB.QueryRow("SHOW server_version_num").Scan(&version)
+		if err == nil {
+			serverVersion, err = strconv.Atoi(version)
+		}
+		if err != nil {
+			logger.Log(nil).Warn().Msg("Cannot read server version: " + err.Error())
+		}
+	}
 	return nil
 }
 
+// Close the connection pool, waiting for queries in progress
+func Close() error {
+	logger.Log(nil).Debug().Msg("Closing database connection")
+	if connection == nil {
+		return nil
+	}
+	metrics.Pool.Set(nil)
+	err := connection.Close()
+	connection = nil
+	serverVersion = 0
+	return err
+}
+
 // Exec query and returns result into json
 func ExecQueryJSON(r *http.Request, query string) (*[]map[string]interface{}, error) {
 	logger.Log(r).Debug().Msg("Executing on database query => " + query)
-	var result []map[string]interface{}
 	var rows *sql.Rows
 	var err error
 
@@ -106,10 +274,36 @@ func ExecQueryJSON(r *http.Request, query string) (*[]map[string]interface{}, er
 	}
 
 	logger.Log(r).Debug().Msg("Mapping result query")
+	return RowsToJSON(rows)
+}
+
+// Map every row of a query result into json
+func RowsToJSON(rows *sql.Rows) (*[]map[string]interface{}, error) {
+	var result []map[string]interface{}
+
+	err := ScanRows(rows, func(row map[string]interface{}) error {
+		result = append(result, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// RowFunc is called on every row mapped by ScanRows
+type RowFunc func(row map[string]interface{}) error
+
+// ScanRows maps rows of a query result into json one at a time, without keeping them
+func ScanRows(rows *sql.Rows, fn RowFunc) error {
 	var cols []string
+	var err error
+
+	defer rows.Close()
+
 	cols, err = rows.Columns()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Result is your slice string.
@@ -126,7 +320,7 @@ func ExecQueryJSON(r *http.Request, query string) (*[]map[string]interface{}, er
 	for rows.Next() {
 		err = rows.Scan(dest...)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		finalrows = make(map[string]interface{})
@@ -138,15 +332,13 @@ func ExecQueryJSON(r *http.Request, query string) (*[]map[string]interface{}, er
 				finalrows[cols[i]] = string(raw)
 			}
 		}
-		result = append(result, finalrows)
-	}
-
-	err = rows.Err()
-	if err != nil {
-		return nil, err
+		err = fn(finalrows)
+		if err != nil {
+			return err
+		}
 	}
 
-	return &result, nil
+	return rows.Err()
 }
 
 // Select primary keys of given table
@@ -207,6 +399,31 @@ func SelectForeignKeys(r *http.Request, tablename string) (*[]map[string]interfa
 	return SelectWithQuery(r, myselect, from, map[string]string{}, where)
 }
 
+// Select foreign keys of other tables referencing given table
+func SelectReferencingKeys(r *http.Request, tablename string) (*[]map[string]interface{}, error) {
+	logger.Log(r).Debug().Msg("Selecting referencing keys on table: " + tablename)
+
+	var myselect = []string{
+		"tc.table_name",
+		"kcu.column_name",
+		"ccu.column_name AS foreign_column_name",
+	}
+
+	var from = "information_schema.table_constraints AS tc " +
+		"JOIN information_schema.key_column_usage AS kcu " +
+		"ON tc.constraint_name = kcu.constraint_name " +
+		"AND tc.table_schema = kcu.table_schema " +
+		"JOIN information_schema.constraint_column_usage AS ccu " +
+		"ON ccu.constraint_name = tc.constraint_name " +
+		"AND ccu.table_schema = tc.table_schema"
+
+	var where = []Builder{
+		Builder{"tc.constraint_type", "FOREIGN KEY", "="},
+		Builder{"ccu.table_name", tablename, "="},
+	}
+	return SelectWithQuery(r, myselect, from, map[string]string{}, where)
+}
+
 func SelectWithQuery(r *http.Request, myselect []string, from string, args map[string]string, where []Builder) (*[]map[string]interface{}, error) {
 	var result *[]map[string]interface{}
 
@@ -270,18 +487,14 @@ func SelectByQuery(from []string, tablename string, args map[string]string, wher
 	var err error
 
 	if GetConnection() == nil {
-		return "", errors.New("Not connected to database")
+		return "", errNotConnected()
 	}
 	dbrSess := connection.NewSession(nil)
 
 	//Build our query
 	builder := dbrSess.Select(from...)
 
-	builder, err = AddArgs(builder, tablename, args, &values)
-	if (err != nil) {
-		return "", err
-	}
-
+	// Where values must come before values of ordering expressions added by args
 	if (len(where) > 0) {
 		builder, err = AddWhere(builder, where, &values)
 		if (err != nil) {
@@ -289,6 +502,11 @@ func SelectByQuery(from []string, tablename string, args map[string]string, wher
 		}
 	}
 
+	builder, err = AddArgs(builder, tablename, args, &values)
+	if (err != nil) {
+		return "", err
+	}
+
 	query, err = builderToQuery(builder, connection.Dialect, values)
 	if err != nil {
 		return "", err
@@ -309,7 +527,7 @@ func ChooseWhereStatement(build Builder) (dbr.Builder, error) {
 	case "=":
 		return dbr.Eq(build.Column, build.Value), nil
 	}
-	return nil, errors.New("Where statement not recognised: " + build.Operand)
+	return nil, invalidArgument("Where statement not recognised: " + build.Operand)
 }
 
 func AddWhere(builder *dbr.SelectStmt, where []Builder, values *[]interface{}) (*dbr.SelectStmt, error) {
@@ -326,6 +544,18 @@ func AddWhere(builder *dbr.SelectStmt, where []Builder, values *[]interface{}) (
 }
 
 func AddArgs(builder *dbr.SelectStmt, tablename string, args map[string]string, values *[]interface{}) (*dbr.SelectStmt,  error) {
+	var err error
+	var havingValues []interface{}
+
+	if val, ok := args[REQUEST_ARG_PREFIX + "select"]; ok {
+		builder, havingValues, err = AddAggregates(builder, tablename, val, args[REQUEST_ARG_PREFIX + "having"])
+		if err != nil {
+			return nil, err
+		}
+	} else if _, ok := args[REQUEST_ARG_PREFIX + "having"]; ok {
+		return nil, invalidArgument("Having needs a select argument")
+	}
+
 	if _, ok := args[REQUEST_ARG_PREFIX + "only"]; ok {
 		tablename = "ONLY " + tablename
 	}
@@ -339,7 +569,29 @@ func AddArgs(builder *dbr.SelectStmt, tablename string, args map[string]string,
 		}
 	}
 
-	if val, ok := args[REQUEST_ARG_PREFIX + "orderby"]; ok {
+	var rank string
+	if val, ok := args[REQUEST_ARG_PREFIX + "search"]; ok {
+		builder, rank, err = AddSearch(builder, strings.TrimPrefix(tablename, "ONLY "), val, args[REQUEST_ARG_PREFIX + "search_columns"], values)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Having values follow where and search values, as having conditions follow the where clause
+	*values = append(*values, havingValues...)
+
+	if val, ok := args[REQUEST_ARG_PREFIX + "orderby"]; ok && val == REQUEST_ARG_PREFIX + "rank" {
+		if rank == "" {
+			return nil, invalidArgument("Order by rank needs a full-text search argument")
+		}
+		// Most relevant rows first unless ascending order is asked
+		if args[REQUEST_ARG_PREFIX + "order"] == "true" {
+			builder.Order = append(builder.Order, dbr.Expr(rank + " ASC", args[REQUEST_ARG_PREFIX + "search"]))
+		} else {
+			builder.Order = append(builder.Order, dbr.Expr(rank + " DESC", args[REQUEST_ARG_PREFIX + "search"]))
+		}
+		*values = append(*values, args[REQUEST_ARG_PREFIX + "search"])
+	} else if val, ok := args[REQUEST_ARG_PREFIX + "orderby"]; ok {
 		if val2, ok2 := args[REQUEST_ARG_PREFIX + "order"]; ok2 {
 			switch val2 {
 			case "true":
@@ -347,7 +599,7 @@ func AddArgs(builder *dbr.SelectStmt, tablename string, args map[string]string,
 			case "false":
 				builder = builder.OrderDesc(val)
 			default:
-				return nil, errors.New("Order should be true or false")
+				return nil, invalidArgument("Order should be true or false")
 			}
 		} else {
 			builder = builder.OrderAsc(val)
@@ -358,13 +610,251 @@ func AddArgs(builder *dbr.SelectStmt, tablename string, args map[string]string,
 		var ret uint64
 		ret, err := strconv.ParseUint(val, 10, 64)
 		if err != nil {
-			return nil, errors.New("Limit value \"" + val + "\" is not a valid number")
+			return nil, invalidArgument("Limit value \"" + val + "\" is not a valid number")
 		}
 		builder = builder.Limit(ret)
 	}
 	return builder, nil
 }
 
+// Escape wildcards of a LIKE pattern
+func escapeLike(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
+
+// FullTextSearch tells if the connected database supports full-text search, websearch_to_tsquery needs PostgreSQL 11
+func FullTextSearch() bool {
+	return connection != nil && connection.Dialect == dialect.PostgreSQL && serverVersion >= 110000
+}
+
+// ParseSearchColumns returns the text columns to search on, every text column when none is asked
+func ParseSearchColumns(tablecolumns map[string]Column, searchColumns string) ([]string, error) {
+	var names []string
+
+	if searchColumns == "" {
+		for name, column := range tablecolumns {
+			if column.IsText() {
+				names = append(names, name)
+			}
+		}
+		if len(names) <= 0 {
+			return nil, invalidArgument("Table does not contain any text column to search on")
+		}
+		sort.Strings(names)
+		return names, nil
+	}
+	for _, name := range strings.Split(searchColumns, ",") {
+		name = strings.TrimSpace(name)
+		column, ok := tablecolumns[name]
+		if !ok {
+			return nil, invalidArgument("Unknown column \"" + name + "\"")
+		}
+		if !column.IsText() {
+			return nil, invalidArgument("Search column \"" + name + "\" is not a text column")
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// BuildFullTextSearch returns the condition matching search terms on given columns and the expression ranking rows
+// Both expressions take the search terms as their only placeholder
+func BuildFullTextSearch(names []string) (string, string) {
+	var document []string
+	for _, name := range names {
+		document = append(document, "coalesce(" + quoteIdent(name) + ", '')")
+	}
+	vector := "to_tsvector(" + strings.Join(document, " || ' ' || ") + ")"
+	return vector + " @@ websearch_to_tsquery(?)", "ts_rank(" + vector + ", websearch_to_tsquery(?))"
+}
+
+// BuildLikeSearch returns a condition matching every word of terms on any of given columns along with its values
+// The condition is case-insensitive and quotes columns as the dialect does, so that any database runs it
+func BuildLikeSearch(d dbr.Dialect, names []string, terms string) (string, []interface{}) {
+	var conditions []string
+	var values []interface{}
+	for _, word := range strings.Fields(terms) {
+		var matches []string
+		for _, name := range names {
+			matches = append(matches, "LOWER(" + d.QuoteIdent(name) + ") LIKE LOWER(?) ESCAPE " + d.EncodeString("\\"))
+			values = append(values, "%" + escapeLike(word) + "%")
+		}
+		conditions = append(conditions, "(" + strings.Join(matches, " OR ") + ")")
+	}
+	return strings.Join(conditions, " AND "), values
+}
+
+// AddSearch filters rows matching search terms, using full-text search when the database supports it
+// The returned rank expression is empty when rows cannot be ranked
+func AddSearch(builder *dbr.SelectStmt, tablename string, terms string, searchColumns string, values *[]interface{}) (*dbr.SelectStmt, string, error) {
+	if strings.TrimSpace(terms) == "" {
+		return builder, "", nil
+	}
+	tablecolumns, err := GetColumns(nil, tablename)
+	if err != nil {
+		return nil, "", err
+	}
+	names, err := ParseSearchColumns(tablecolumns, searchColumns)
+	if err != nil {
+		return nil, "", err
+	}
+	if FullTextSearch() {
+		condition, rank := BuildFullTextSearch(names)
+		*values = append(*values, terms)
+		return builder.Where(dbr.Expr(condition, terms)), rank, nil
+	}
+	condition, likeValues := BuildLikeSearch(connection.Dialect, names, terms)
+	*values = append(*values, likeValues...)
+	return builder.Where(dbr.Expr(condition, likeValues...)), "", nil
+}
+
+// Aggregate functions allowed in select argument
+var aggregateFunctions = map[string]bool{
+	"count": true,
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+}
+
+// Operands allowed in having argument, longest first
+var havingOperands = []string{">=", "<=", "!=", "=", ">", "<"}
+
+func quoteIdent(name string) string {
+	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
+
+// ParseAggregate converts an item like sum(amount) or count() into a sql expression and its alias
+func ParseAggregate(tablecolumns map[string]Column, item string) (string, string, error) {
+	pos := strings.Index(item, "(")
+	if pos <= 0 || !strings.HasSuffix(item, ")") {
+		return "", "", invalidArgument("Aggregate \"" + item + "\" is not a valid function call")
+	}
+	function := strings.ToLower(strings.TrimSpace(item[:pos]))
+	argument := strings.TrimSpace(item[pos+1 : len(item)-1])
+	if !aggregateFunctions[function] {
+		return "", "", invalidArgument("Aggregate function \"" + function + "\" is not allowed")
+	}
+	if argument == "" {
+		if function != "count" {
+			return "", "", invalidArgument("Aggregate function \"" + function + "\" needs a column")
+		}
+		return "count(*)", "count", nil
+	}
+	column, ok := tablecolumns[argument]
+	if !ok {
+		return "", "", invalidArgument("Unknown column \"" + argument + "\"")
+	}
+	if (function == "sum" || function == "avg") && !column.IsNumeric() {
+		return "", "", invalidArgument("Aggregate function \"" + function + "\" needs a numeric column but \"" + argument + "\" is " + column.Type)
+	}
+	return function + "(" + quoteIdent(argument) + ")", function + "_" + argument, nil
+}
+
+// ParseSelect converts a select argument into select expressions and the columns to group by
+func ParseSelect(tablecolumns map[string]Column, selectArg string) ([]string, []string, error) {
+	var selects []string
+	var groupby []string
+	var hasAggregate bool
+
+	for _, item := range strings.Split(selectArg, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.Contains(item, "(") {
+			expr, alias, err := ParseAggregate(tablecolumns, item)
+			if err != nil {
+				return nil, nil, err
+			}
+			selects = append(selects, expr + " AS " + quoteIdent(alias))
+			hasAggregate = true
+		} else {
+			if _, ok := tablecolumns[item]; !ok {
+				return nil, nil, invalidArgument("Unknown column \"" + item + "\"")
+			}
+			selects = append(selects, quoteIdent(item))
+			groupby = append(groupby, quoteIdent(item))
+		}
+	}
+	if len(selects) <= 0 {
+		return nil, nil, invalidArgument("Select argument is empty")
+	}
+	if !hasAggregate {
+		groupby = nil
+	}
+	return selects, groupby, nil
+}
+
+// ParseHaving converts a having argument like count()>5,sum(amount)<=100 into sql conditions and their values
+func ParseHaving(tablecolumns map[string]Column, havingArg string) ([]string, []interface{}, error) {
+	var conditions []string
+	var values []interface{}
+
+	for _, item := range strings.Split(havingArg, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		operand := ""
+		pos := -1
+		for _, op := range havingOperands {
+			if pos = strings.Index(item, op); pos > 0 {
+				operand = op
+				break
+			}
+		}
+		if operand == "" {
+			return nil, nil, invalidArgument("Having statement not recognised: " + item)
+		}
+		expr, _, err := ParseAggregate(tablecolumns, strings.TrimSpace(item[:pos]))
+		if err != nil {
+			return nil, nil, err
+		}
+		value := strings.TrimSpace(item[pos+len(operand):])
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(number) || math.IsInf(number, 0) {
+			return nil, nil, invalidArgument("Having value \"" + value + "\" is not a valid number")
+		}
+		conditions = append(conditions, expr + " " + operand + " ?")
+		values = append(values, number)
+	}
+	return conditions, values, nil
+}
+
+// AddAggregates replaces selected columns and groups rows when aggregate functions are asked
+// It returns the values of the placeholders of having conditions
+func AddAggregates(builder *dbr.SelectStmt, tablename string, selectArg string, havingArg string) (*dbr.SelectStmt, []interface{}, error) {
+	var values []interface{}
+
+	tablecolumns, err := GetColumns(nil, tablename)
+	if err != nil {
+		return nil, nil, err
+	}
+	selects, groupby, err := ParseSelect(tablecolumns, selectArg)
+	if err != nil {
+		return nil, nil, err
+	}
+	builder.Column = make([]interface{}, 0, len(selects))
+	for _, expr := range selects {
+		builder.Column = append(builder.Column, expr)
+	}
+	if len(groupby) > 0 {
+		builder = builder.GroupBy(groupby...)
+	}
+	if havingArg != "" {
+		var conditions []string
+		conditions, values, err = ParseHaving(tablecolumns, havingArg)
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, condition := range conditions {
+			builder = builder.Having(condition, values[i])
+		}
+	}
+	return builder, values, nil
+}
+
 func AddNestedObjects(r *http.Request, results *[]map[string]interface{}, tablename string) (*[]map[string]interface{}, error) {
 	var resultsNested *[]map[string]interface{}
 	logger.Log(r).Debug().Msg("Adding nested objects on table: " + tablename)
@@ -384,13 +874,23 @@ func AddNestedObjects(r *http.Request, results *[]map[string]interface{}, tablen
 			foreign_table_name := fmt.Sprintf("%v", foreignKeyMap["foreign_table_name"])
 			foreign_column_name := fmt.Sprintf("%v", foreignKeyMap["foreign_column_name"])
 			column_name := fmt.Sprintf("%v", foreignKeyMap["column_name"])
-			
+			// Keys may be left out by the policy of the table
+			value, ok := resultMap[column_name]
+			if !ok || value == nil {
+				continue
+			}
+
 			args := map[string]string{
-				foreign_column_name : fmt.Sprintf("%v", resultMap[column_name]),
+				foreign_column_name : fmt.Sprintf("%v", value),
 				REQUEST_ARG_PREFIX + "nested" : "",
 			}
 
-			resultsNested, err = Select(r, foreign_table_name, args)
+			// Nested rows are read with the policy of their own table
+			nestedRequest, err := NestedRequest(r, foreign_table_name, http.MethodGet)
+			if err != nil {
+				return results, err
+			}
+			resultsNested, err = Select(nestedRequest, foreign_table_name, args)
 			if (err != nil) {
 				return results, err
 			} else {
@@ -403,14 +903,59 @@ func AddNestedObjects(r *http.Request, results *[]map[string]interface{}, tablen
 	return results, nil
 }
 
+// SelectRows executes a select on table and passes its rows to fn without reading them, so they can be streamed
+func SelectRows(r *http.Request, tablename string, args map[string]string, fn func(rows *sql.Rows) error) (err error) {
+	logger.Log(r).Debug().Msg("Selecting rows to stream on table: " + tablename)
+	r, q := startQuery(r, tablename, "select")
+	defer func() { q.end(err) }()
+
+	myselect, where, args, err := PolicyQuery(r, tablename, args)
+	if err != nil {
+		return err
+	}
+	query, err := SelectByQuery(myselect, tablename, args, where)
+	if err != nil {
+		return err
+	}
+	return QueryRows(r, query, fn)
+}
+
 // Select retrieves row(s)
-func Select(r *http.Request, tablename string, args map[string]string) (*[]map[string]interface{}, error) {
-	return SelectWithQuery(r, []string{"*"}, tablename, args, []Builder{})
+func Select(r *http.Request, tablename string, args map[string]string) (result *[]map[string]interface{}, err error) {
+	logger.Log(r).Debug().Msg("Selecting on table: " + tablename)
+	r, q := startQuery(r, tablename, "select")
+	defer func() { q.end(err) }()
+
+	myselect, where, args, err := PolicyQuery(r, tablename, args)
+	if err != nil {
+		return nil, err
+	}
+	query, err := SelectByQuery(myselect, tablename, args, where)
+	if err != nil {
+		return nil, err
+	}
+	err = QueryRows(r, query, func(rows *sql.Rows) error {
+		result, err = RowsToJSON(rows)
+		return err
+	})
+	if err == nil {
+		q.count(int64(len(*result)))
+		// Nested objects are looked up with the actual values of keys, masked afterwards
+		if _, ok := args[REQUEST_ARG_PREFIX + "nested"]; ok {
+			result, err = AddNestedObjects(r, result, tablename)
+		}
+		for _, row := range *result {
+			MaskRow(r, tablename, row)
+		}
+	}
+	return result, err
 }
 
 // Insert add row(s)
-func Insert(r *http.Request, tablename string, args map[string]string, json []map[string]interface{}) (*[]map[string]interface{}, error) {
+func Insert(r *http.Request, tablename string, args map[string]string, json []map[string]interface{}) (_ *[]map[string]interface{}, err error) {
 	logger.Log(r).Debug().Msg("Inserting on table: " + tablename)
+	r, q := startQuery(r, tablename, OperationInsert)
+	defer func() { q.end(err) }()
 
 	var builder *dbr.InsertStmt
 	var id int64 = 0
@@ -421,16 +966,20 @@ func Insert(r *http.Request, tablename string, args map[string]string, json []ma
 	var v interface{}
 
 	if GetConnection() == nil {
-		return nil, errors.New("Not connected to database")
+		return nil, errNotConnected()
 	}
-	dbrSess := connection.NewSession(nil)
 
 	size_json := len(json)
 	if size_json <= 0 {
-		return nil, errors.New("Missing data in json")
+		return nil, invalidBody("Missing data in json")
 	}
 
-	tx, err := dbrSess.Begin()
+	err = ApplyPolicyRows(r, tablename, json, true)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := Begin(r)
 	if err != nil {
 		return nil, err
 	}
@@ -440,6 +989,18 @@ func Insert(r *http.Request, tablename string, args map[string]string, json []ma
 	defer tx.RollbackUnlessCommitted()
 
 	for i := 0; i < size_json; i++ {
+		_, nested, err := SplitNestedObjects(r, json[i])
+		if err != nil {
+			return nil, err
+		}
+		if len(nested) > 0 {
+			err = insertNestedObject(r, tx, tablename, json[i], []string{val})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		//Build our query
 		builder = tx.InsertInto(tablename)
 
@@ -461,6 +1022,7 @@ func Insert(r *http.Request, tablename string, args map[string]string, json []ma
 		} else {
 			_, err = builder.Exec()
 		}
+		traceBuilder(r, builder)
 
 		if err != nil {
 			return nil, err
@@ -470,15 +1032,239 @@ func Insert(r *http.Request, tablename string, args map[string]string, json []ma
 			json[i]["id"] = id
 		}
 	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	q.count(int64(size_json))
+	publishInsert(r, tablename, json)
 	if returning {
-		return &json, tx.Commit()
+		return &json, nil
+	}
+	return nil, nil
+}
+
+// SplitNestedObjects separates plain columns of a row from objects keyed by a table name
+func SplitNestedObjects(r *http.Request, row map[string]interface{}) (map[string]interface{}, map[string][]map[string]interface{}, error) {
+	var columns = map[string]interface{}{}
+	var nested = map[string][]map[string]interface{}{}
+
+	for key, value := range row {
+		switch value.(type) {
+		case map[string]interface{}, []interface{}, []map[string]interface{}:
+		default:
+			columns[key] = value
+			continue
+		}
+		alltables, err := GetTables(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := alltables[key]; !ok {
+			// Not a table, most likely a json column
+			columns[key] = value
+			continue
+		}
+		objects, err := toObjects(value)
+		if err != nil {
+			return nil, nil, invalidBody("Nested " + key + ": " + err.Error())
+		}
+		nested[key] = objects
+	}
+	return columns, nested, nil
+}
+
+// Convert a nested json value into a list of objects
+func toObjects(value interface{}) ([]map[string]interface{}, error) {
+	switch val := value.(type) {
+	case map[string]interface{}:
+		return []map[string]interface{}{val}, nil
+	case []map[string]interface{}:
+		return val, nil
+	case []interface{}:
+		objects := make([]map[string]interface{}, 0, len(val))
+		for _, item := range val {
+			object, ok := item.(map[string]interface{})
+			if !ok {
+				return nil, invalidBody("array must only contain objects")
+			}
+			objects = append(objects, object)
+		}
+		return objects, nil
+	}
+	return nil, invalidBody("value must be an object or an array of objects")
+}
+
+// InsertNested adds a row with its nested rows of related tables inside the given transaction
+// Referenced rows are inserted first so their keys can be set on the row,
+// then the row is inserted and its keys are propagated into referencing rows
+func InsertNested(r *http.Request, tx *dbr.Tx, tablename string, row map[string]interface{}, nested map[string][]map[string]interface{}, returning []string) error {
+	logger.Log(r).Debug().Msg("Inserting nested objects on table: " + tablename)
+
+	var children = map[string][]map[string]interface{}{}
+
+	if len(nested) <= 0 {
+		return insertReturning(r, tx, tablename, row, returning)
+	}
+
+	foreignKeys, err := SelectForeignKeys(r, tablename)
+	if err != nil {
+		return err
+	}
+	referencingKeys, err := SelectReferencingKeys(r, tablename)
+	if err != nil {
+		return err
+	}
+
+	var childKeys []map[string]interface{}
+	for nestedtable, objects := range nested {
+		foreignKeyMap, referencingKeyMap, err := nestedRelation(tablename, nestedtable, *foreignKeys, *referencingKeys)
+		if err != nil {
+			return err
+		}
+		if foreignKeyMap != nil {
+			if len(objects) != 1 {
+				return invalidBody("Nested " + nestedtable + " must be a single object")
+			}
+			foreign_column_name := fmt.Sprintf("%v", foreignKeyMap["foreign_column_name"])
+			err = insertNestedObject(r, tx, nestedtable, objects[0], []string{foreign_column_name})
+			if err != nil {
+				return err
+			}
+			row[fmt.Sprintf("%v", foreignKeyMap["column_name"])] = objects[0][foreign_column_name]
+			continue
+		}
+		children[nestedtable] = objects
+		childKeys = append(childKeys, referencingKeyMap)
+		returning = append(returning, fmt.Sprintf("%v", referencingKeyMap["foreign_column_name"]))
+	}
+
+	err = insertReturning(r, tx, tablename, row, returning)
+	if err != nil {
+		return err
+	}
+
+	for _, referencingKeyMap := range childKeys {
+		childtable := fmt.Sprintf("%v", referencingKeyMap["table_name"])
+		column_name := fmt.Sprintf("%v", referencingKeyMap["column_name"])
+		foreign_column_name := fmt.Sprintf("%v", referencingKeyMap["foreign_column_name"])
+		for _, child := range children[childtable] {
+			child[column_name] = row[foreign_column_name]
+		}
+	}
+	for childtable, objects := range children {
+		for _, child := range objects {
+			err = insertNestedObject(r, tx, childtable, child, []string{})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Find the single foreign key relating a table to a nested table, either a key of the table referencing the nested table
+// or a key of the nested table referencing the table
+func nestedRelation(tablename string, nestedtable string, foreignKeys []map[string]interface{}, referencingKeys []map[string]interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	var foreignKeyMap, referencingKeyMap map[string]interface{}
+	var found int
+
+	for _, keyMap := range foreignKeys {
+		if fmt.Sprintf("%v", keyMap["foreign_table_name"]) == nestedtable {
+			foreignKeyMap = keyMap
+			found++
+		}
+	}
+	for _, keyMap := range referencingKeys {
+		if fmt.Sprintf("%v", keyMap["table_name"]) == nestedtable {
+			referencingKeyMap = keyMap
+			found++
+		}
+	}
+	if found <= 0 {
+		return nil, nil, invalidBody("No foreign key between " + tablename + " and " + nestedtable)
+	}
+	if found > 1 {
+		return nil, nil, invalidBody("Several foreign keys between " + tablename + " and " + nestedtable + ", nested " + nestedtable + " is ambiguous")
+	}
+	return foreignKeyMap, referencingKeyMap, nil
+}
+
+// Insert a nested object which may itself contain nested objects
+func insertNestedObject(r *http.Request, tx *dbr.Tx, tablename string, object map[string]interface{}, returning []string) error {
+	columns, nested, err := SplitNestedObjects(r, object)
+	if err != nil {
+		return err
+	}
+	err = InsertNested(r, tx, tablename, columns, nested, returning)
+	if err != nil {
+		return err
 	}
-	return nil, tx.Commit()
+	// Keep generated values visible to the caller
+	for key, value := range columns {
+		object[key] = value
+	}
+	return nil
+}
+
+// Insert a single row and fill it with the values of returned columns
+func insertReturning(r *http.Request, tx *dbr.Tx, tablename string, row map[string]interface{}, returning []string) error {
+	var keys = make([]string, 0, len(row))
+	var values = make([]interface{}, 0, len(row))
+	var columns []string
+
+	for k, v := range row {
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+	for _, column := range returning {
+		if _, ok := row[column]; !ok && column != "" {
+			columns = append(columns, column)
+		}
+	}
+
+	builder := tx.InsertInto(tablename)
+	builder.Value = append(builder.Value, values)
+	builder.Column = keys
+
+	if len(columns) <= 0 {
+		_, err := builder.Exec()
+		return err
+	}
+
+	builder = builder.Returning(columns...)
+	buf := dbr.NewBuffer()
+	err := builder.Build(connection.Dialect, buf)
+	if err != nil {
+		return err
+	}
+	query, err := dbr.InterpolateForDialect(buf.String(), buf.Value(), connection.Dialect)
+	if err != nil {
+		return err
+	}
+	logger.Log(r).Debug().Msg("Executing on database query => " + query)
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	result, err := RowsToJSON(rows)
+	if err != nil {
+		return err
+	}
+	if len(*result) != 1 {
+		return apierror.New(http.StatusNotFound, apierror.CodeNotFound, "sql: no rows in result set for " + tablename).WithTable(tablename)
+	}
+	for key, value := range (*result)[0] {
+		row[key] = value
+	}
+	return nil
 }
 
 // Update upgrade row(s)
-func Update(r *http.Request, tablename string, args map[string]string, json []map[string]interface{}) error {
+func Update(r *http.Request, tablename string, args map[string]string, json []map[string]interface{}) (err error) {
 	logger.Log(r).Debug().Msg("Updating on table: " + tablename)
+	r, q := startQuery(r, tablename, OperationUpdate)
+	defer func() { q.end(err) }()
 
 	var builder *dbr.UpdateStmt
 	var value interface{}
@@ -488,13 +1274,21 @@ func Update(r *http.Request, tablename string, args map[string]string, json []ma
 	var nb int64
 
 	if GetConnection() == nil {
-		return errors.New("Not connected to database")
+		return errNotConnected()
 	}
-	dbrSess := connection.NewSession(nil)
 
 	size_json := len(json)
 	if size_json <= 0 {
-		return errors.New("Missing data in json")
+		return invalidBody("Missing data in json")
+	}
+
+	err = ApplyPolicyRows(r, tablename, json, false)
+	if err != nil {
+		return err
+	}
+	filters, err := PolicyFilters(r, tablename, map[string]string{})
+	if err != nil {
+		return err
 	}
 
 	res, err := SelectPrimaryKeys(r, tablename)
@@ -502,7 +1296,7 @@ func Update(r *http.Request, tablename string, args map[string]string, json []ma
 		return err
 	}
 
-	tx, err := dbrSess.Begin()
+	tx, err := Begin(r)
 	if err != nil {
 		return err
 	}
@@ -531,67 +1325,145 @@ func Update(r *http.Request, tablename string, args map[string]string, json []ma
 			}
 		}
 		if len(pk_fields_check) != size_res {
-			return errors.New("Missing primary keys in json (" + 
+			return invalidBody("Missing primary keys in json (" + 
 				strings.Join(logger.DiffArrays(pk_fields_check, pk_fields), ", ") + ")")
 		}
+		for key, filter := range filters {
+			builder = builder.Where(dbr.Eq(key, filter))
+		}
 
+		traceBuilder(r, builder)
 		result, err = builder.Exec()
 		if err == nil {
 			nb, err = result.RowsAffected()
+			q.count(nb)
 		}
 
 		if err != nil {
 			return err
 		} else if nb <= 0 {
-			return errors.New("sql: no rows in result set for " + fmt.Sprintf("%#v", json[i]))
+			return apierror.New(http.StatusNotFound, apierror.CodeNotFound, "sql: no rows in result set for " + fmt.Sprintf("%#v", json[i]))
 		}
 	}
-	return tx.Commit()
+	err = tx.Commit()
+	if err == nil {
+		publish(r, tablename, OperationUpdate, json)
+	}
+	return err
 }
 
 // Delete removes row(s)
-func Delete(r *http.Request, tablename string, args map[string]string) error {
+func Delete(r *http.Request, tablename string, args map[string]string) (err error) {
 	logger.Log(r).Debug().Msg("Deleting on table: " + tablename)
+	r, q := startQuery(r, tablename, OperationDelete)
+	defer func() { q.end(err) }()
 	if GetConnection() == nil {
-		return errors.New("Not connected to database")
+		return errNotConnected()
 	}
 	if !(args != nil && len(args) > 0) {
-		return errors.New("Delete on all rows is disabled")
+		return invalidBody("Delete on all rows is disabled")
+	}
+	filters, err := PolicyFilters(r, tablename, args)
+	if err != nil {
+		return err
 	}
 
-	dbrSess := connection.NewSession(nil)
+	tx, err := Begin(r)
+	if err != nil {
+		return err
+	}
+	defer tx.RollbackUnlessCommitted()
 
 	//Build our query
-	builder := dbrSess.DeleteFrom(tablename)
+	builder := tx.DeleteFrom(tablename)
 
 	for key, value := range args {
 		builder = builder.Where(dbr.Eq(key, value))
 	}
+	for key, filter := range filters {
+		builder = builder.Where(dbr.Eq(key, filter))
+	}
 
-	_, err := builder.Exec()
+	deleted, err := deleteRows(r, tx, q, builder, argsToRow(args))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err == nil && len(deleted) > 0 {
+		publish(r, tablename, OperationDelete, deleted)
+	}
 	return err
 }
 
+// Execute a delete and return the deleted rows, read with RETURNING on PostgreSQL
+// Other dialects return the filters of the delete as the row it identified, when rows were deleted
+func deleteRows(r *http.Request, tx *dbr.Tx, q *tableQuery, builder *dbr.DeleteStmt, filters map[string]interface{}) ([]map[string]interface{}, error) {
+	if connection.Dialect != dialect.PostgreSQL {
+		traceBuilder(r, builder)
+		result, err := builder.Exec()
+		if err != nil {
+			return nil, err
+		}
+		q.affected(result)
+		if nb, err := result.RowsAffected(); err != nil || nb <= 0 {
+			return nil, nil
+		}
+		return []map[string]interface{}{filters}, nil
+	}
+
+	buf := dbr.NewBuffer()
+	err := builder.Build(connection.Dialect, buf)
+	if err != nil {
+		return nil, err
+	}
+	query, err := dbr.InterpolateForDialect(buf.String(), buf.Value(), connection.Dialect)
+	if err != nil {
+		return nil, err
+	}
+	query += " RETURNING *"
+	logger.Log(r).Debug().Msg("Executing on database query => " + query)
+	traceStatement(r, query)
+	rows, err := tx.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := RowsToJSON(rows)
+	if err != nil {
+		return nil, err
+	}
+	q.count(int64(len(*deleted)))
+	return *deleted, nil
+}
+
 // Delete removes multiple row(s)
-func DeleteMultiple(r *http.Request, tablename string, args []map[string]interface{}) error {
+func DeleteMultiple(r *http.Request, tablename string, args []map[string]interface{}) (err error) {
 	logger.Log(r).Debug().Msg("Deleting multiple rows on table: " + tablename)
+	r, q := startQuery(r, tablename, OperationDelete)
+	defer func() { q.end(err) }()
 
 	var builder *dbr.DeleteStmt
+	var deleted []map[string]interface{}
 	var value interface{}
 	var key string
 
 	if GetConnection() == nil {
-		return errors.New("Not connected to database")
+		return errNotConnected()
 	}
 
 	size := len(args)
 	if size <= 0 {
-		return errors.New("Missing data in arguments")
+		return invalidBody("Missing data in arguments")
+	}
+	err = ApplyPolicyRows(r, tablename, args, false)
+	if err != nil {
+		return err
+	}
+	filters, err := PolicyFilters(r, tablename, map[string]string{})
+	if err != nil {
+		return err
 	}
 
-	dbrSess := connection.NewSession(nil)
-
-	tx, err := dbrSess.Begin()
+	tx, err := Begin(r)
 	if err != nil {
 		return err
 	}
@@ -605,12 +1477,20 @@ func DeleteMultiple(r *http.Request, tablename string, args []map[string]interfa
 			for key, value = range args[i] {
 				builder = builder.Where(dbr.Eq(key, value))
 			}
+			for key, filter := range filters {
+				builder = builder.Where(dbr.Eq(key, filter))
+			}
 
-			_, err = builder.Exec()
+			rows, err := deleteRows(r, tx, q, builder, args[i])
 			if err != nil {
 				return err
 			}
+			deleted = append(deleted, rows...)
 		}
 	}
-	return tx.Commit()
+	err = tx.Commit()
+	if err == nil && len(deleted) > 0 {
+		publish(r, tablename, OperationDelete, deleted)
+	}
+	return err
 }
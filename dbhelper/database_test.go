@@ -1,9 +1,23 @@
 package dbhelper
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/gocraft/dbr"
+	"github.com/gocraft/dbr/dialect"
+	"github.com/lib/pq"
+	"github.com/maxime1907/crudify/apierror"
+
 	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/metrics"
+	"github.com/maxime1907/crudify/tracing"
 )
 
 const filename string = "test_config"
@@ -43,3 +57,560 @@ func TestFormatSettings(t *testing.T) {
 		})
 	}
 }
+
+func TestToObjects(t *testing.T) {
+	type args struct {
+		value interface{}
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    int
+		wantErr bool
+	}{
+		{
+			name: "Single object",
+			args: args{
+				value: map[string]interface{}{"name": "item"},
+			},
+			want: 1,
+		},
+		{
+			name: "Array of objects",
+			args: args{
+				value: []interface{}{
+					map[string]interface{}{"name": "item1"},
+					map[string]interface{}{"name": "item2"},
+				},
+			},
+			want: 2,
+		},
+		{
+			name: "Array of scalars",
+			args: args{
+				value: []interface{}{"item1", "item2"},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := toObjects(tt.args.value)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("toObjects() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if len(got) != tt.want {
+				t.Errorf("toObjects() = %v, want %v objects", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNestedRelation(t *testing.T) {
+	foreignKeys := []map[string]interface{}{
+		{"column_name": "created_by", "foreign_table_name": "users", "foreign_column_name": "id"},
+		{"column_name": "updated_by", "foreign_table_name": "users", "foreign_column_name": "id"},
+		{"column_name": "category_id", "foreign_table_name": "categories", "foreign_column_name": "id"},
+		{"column_name": "parent_id", "foreign_table_name": "orders", "foreign_column_name": "id"},
+	}
+	referencingKeys := []map[string]interface{}{
+		{"table_name": "items", "column_name": "order_id", "foreign_column_name": "id"},
+		{"table_name": "orders", "column_name": "parent_id", "foreign_column_name": "id"},
+	}
+	tests := []struct {
+		name        string
+		nestedtable string
+		foreign     bool
+		referencing bool
+		wantErr     bool
+	}{
+		{name: "Referenced table", nestedtable: "categories", foreign: true},
+		{name: "Referencing table", nestedtable: "items", referencing: true},
+		{name: "Two foreign keys to the same table", nestedtable: "users", wantErr: true},
+		{name: "Referenced and referencing table", nestedtable: "orders", wantErr: true},
+		{name: "Unrelated table", nestedtable: "payments", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			foreignKeyMap, referencingKeyMap, err := nestedRelation("orders", tt.nestedtable, foreignKeys, referencingKeys)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nestedRelation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if apiErr, ok := err.(*apierror.Error); err != nil && (!ok || apiErr.Status != http.StatusBadRequest) {
+				t.Errorf("nestedRelation() error = %v, want bad request", err)
+			}
+			if (foreignKeyMap != nil) != tt.foreign || (referencingKeyMap != nil) != tt.referencing {
+				t.Errorf("nestedRelation() = %v, %v", foreignKeyMap, referencingKeyMap)
+			}
+		})
+	}
+}
+
+var testColumns = map[string]Column{
+	"status": Column{Name: "status", Type: "character varying"},
+	"amount": Column{Name: "amount", Type: "numeric"},
+}
+
+func TestParseSelect(t *testing.T) {
+	type args struct {
+		selectArg string
+	}
+	tests := []struct {
+		name        string
+		args        args
+		wantSelects []string
+		wantGroupby []string
+		wantErr     bool
+	}{
+		{
+			name: "Columns only",
+			args: args{
+				selectArg: "status,amount",
+			},
+			wantSelects: []string{`"status"`, `"amount"`},
+		},
+		{
+			name: "Aggregates with implicit group by",
+			args: args{
+				selectArg: "status,count(),sum(amount)",
+			},
+			wantSelects: []string{`"status"`, `count(*) AS "count"`, `sum("amount") AS "sum_amount"`},
+			wantGroupby: []string{`"status"`},
+		},
+		{
+			name: "Unknown column",
+			args: args{
+				selectArg: "status,unknown",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Unknown aggregate function",
+			args: args{
+				selectArg: "status,pg_sleep(amount)",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Sum on a text column",
+			args: args{
+				selectArg: "sum(status)",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selects, groupby, err := ParseSelect(testColumns, tt.args.selectArg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSelect() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(selects, tt.wantSelects) {
+				t.Errorf("ParseSelect() selects = %v, want %v", selects, tt.wantSelects)
+			}
+			if !reflect.DeepEqual(groupby, tt.wantGroupby) {
+				t.Errorf("ParseSelect() groupby = %v, want %v", groupby, tt.wantGroupby)
+			}
+		})
+	}
+}
+
+func TestParseHaving(t *testing.T) {
+	type args struct {
+		havingArg string
+	}
+	tests := []struct {
+		name       string
+		args       args
+		want       []string
+		wantValues []interface{}
+		wantErr    bool
+	}{
+		{
+			name: "Multiple conditions",
+			args: args{
+				havingArg: "count()>5,sum(amount)<=100.5",
+			},
+			want:       []string{`count(*) > ?`, `sum("amount") <= ?`},
+			wantValues: []interface{}{float64(5), 100.5},
+		},
+		{
+			name: "Value is not a number",
+			args: args{
+				havingArg: "count()>'5'",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Value is not finite",
+			args: args{
+				havingArg: "sum(amount)>NaN,count()<Inf",
+			},
+			wantErr: true,
+		},
+		{
+			name: "Missing operand",
+			args: args{
+				havingArg: "count()",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotValues, err := ParseHaving(testColumns, tt.args.havingArg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseHaving() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseHaving() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(gotValues, tt.wantValues) {
+				t.Errorf("ParseHaving() values = %v, want %v", gotValues, tt.wantValues)
+			}
+		})
+	}
+}
+
+func TestSelectByQueryHaving(t *testing.T) {
+	columns["having_test"] = testColumns
+	defer delete(columns, "having_test")
+	connection = &dbr.Connection{Dialect: dialect.PostgreSQL}
+	defer func() { connection = nil }()
+
+	args := map[string]string{"status": "paid", "_select": "status,sum(amount)", "_having": "sum(amount)>=100.5"}
+	query, err := SelectByQueryArgs([]string{"*"}, "having_test", args)
+	if err != nil {
+		t.Fatalf("SelectByQueryArgs() error = %v", err)
+	}
+	for _, part := range []string{`"status" = 'paid'`, `sum("amount") >= 100.5`} {
+		if !strings.Contains(query, part) {
+			t.Errorf("SelectByQueryArgs() = %v, want %v", query, part)
+		}
+	}
+	if strings.Contains(query, "?") {
+		t.Errorf("SelectByQueryArgs() = %v, want every placeholder replaced", query)
+	}
+}
+
+func TestParseSearchColumns(t *testing.T) {
+	type args struct {
+		searchColumns string
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "Every text column",
+			args: args{
+				searchColumns: "",
+			},
+			want: []string{"status"},
+		},
+		{
+			name: "Numeric column",
+			args: args{
+				searchColumns: "status,amount",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSearchColumns(testColumns, tt.args.searchColumns)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseSearchColumns() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSearchColumns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildSearch(t *testing.T) {
+	condition, rank := BuildFullTextSearch([]string{"name", "description"})
+	wantVector := `to_tsvector(coalesce("name", '') || ' ' || coalesce("description", ''))`
+	if want := wantVector + ` @@ websearch_to_tsquery(?)`; condition != want {
+		t.Errorf("BuildFullTextSearch() condition = %v, want %v", condition, want)
+	}
+	if want := `ts_rank(` + wantVector + `, websearch_to_tsquery(?))`; rank != want {
+		t.Errorf("BuildFullTextSearch() rank = %v, want %v", rank, want)
+	}
+
+	condition, values := BuildLikeSearch(dialect.PostgreSQL, []string{"name", "description"}, "100% sure")
+	match := `LOWER("name") LIKE LOWER(?) ESCAPE '\' OR LOWER("description") LIKE LOWER(?) ESCAPE '\'`
+	if want := "(" + match + ") AND (" + match + ")"; condition != want {
+		t.Errorf("BuildLikeSearch() condition = %v, want %v", condition, want)
+	}
+	condition, _ = BuildLikeSearch(dialect.MySQL, []string{"name"}, "sure")
+	if want := "(LOWER(`name`) LIKE LOWER(?) ESCAPE '\\\\')"; condition != want {
+		t.Errorf("BuildLikeSearch() on MySQL condition = %v, want %v", condition, want)
+	}
+	wantValues := []interface{}{`%100\%%`, `%100\%%`, "%sure%", "%sure%"}
+	if !reflect.DeepEqual(values, wantValues) {
+		t.Errorf("BuildLikeSearch() values = %v, want %v", values, wantValues)
+	}
+}
+
+func TestDatabaseError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"No rows", sql.ErrNoRows, http.StatusNotFound, apierror.CodeNotFound},
+		{"Unique", &pq.Error{Code: "23505", Table: "crudify", Constraint: "crudify_pkey"}, http.StatusConflict, apierror.CodeUniqueViolation},
+		{"Foreign key", &pq.Error{Code: "23503"}, http.StatusConflict, apierror.CodeForeignKeyViolation},
+		{"Not null", &pq.Error{Code: "23502", Column: "name"}, http.StatusConflict, apierror.CodeNotNullViolation},
+		{"Undefined table", &pq.Error{Code: "42P01"}, http.StatusNotFound, apierror.CodeUndefinedTable},
+		{"Undefined column", &pq.Error{Code: "42703"}, http.StatusBadRequest, apierror.CodeUndefinedColumn},
+		{"Invalid value", &pq.Error{Code: "22P02"}, http.StatusBadRequest, apierror.CodeInvalidValue},
+		{"Unknown", &pq.Error{Code: "XX000"}, http.StatusInternalServerError, apierror.CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := DatabaseError(tt.err).(*apierror.Error)
+			if !ok {
+				t.Fatalf("DatabaseError() = %v, want an *apierror.Error", got)
+			}
+			if got.Status != tt.wantStatus || got.Code != tt.wantCode {
+				t.Errorf("DatabaseError() = %v %v, want %v %v", got.Status, got.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+
+	got := DatabaseError(&pq.Error{Code: "23505", Table: "crudify", Constraint: "crudify_pkey", Detail: "Key (id)=(1) already exists."}).(*apierror.Error)
+	if got.Table != "crudify" || got.Constraint != "crudify_pkey" || got.Details != "Key (id)=(1) already exists." {
+		t.Errorf("DatabaseError() = %+v, want table, constraint and details filled", got)
+	}
+
+	other := errors.New("other")
+	if got := DatabaseError(other); got != other {
+		t.Errorf("DatabaseError() = %v, want %v", got, other)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	columns["policy_test"] = map[string]Column{
+		"id":       Column{Name: "id", Type: "integer"},
+		"owner_id": Column{Name: "owner_id", Type: "text"},
+		"name":     Column{Name: "name", Type: "text"},
+		"salary":   Column{Name: "salary", Type: "numeric"},
+		"notes":    Column{Name: "notes", Type: "text"},
+	}
+	defer delete(columns, "policy_test")
+
+	policy := Policy{Table: "policy_test", DenyColumns: []string{"salary", "notes"}, Filters: map[string]string{"owner_id": "42"}}
+	r := WithPolicy(httptest.NewRequest("GET", "/policy_test", nil), policy)
+
+	myselect, where, args, err := PolicyQuery(r, "policy_test", map[string]string{"name": "a", "_search": "a"})
+	if err != nil {
+		t.Fatalf("PolicyQuery() error = %v", err)
+	}
+	if want := []string{`"id"`, `"name"`, `"owner_id"`}; !reflect.DeepEqual(myselect, want) {
+		t.Errorf("PolicyQuery() select = %v, want %v", myselect, want)
+	}
+	if want := []Builder{{Column: "owner_id", Value: "42", Operand: "="}}; !reflect.DeepEqual(where, want) {
+		t.Errorf("PolicyQuery() where = %v, want %v", where, want)
+	}
+	if args["_search_columns"] != "name,owner_id" {
+		t.Errorf("PolicyQuery() search columns = %v, want name,owner_id", args["_search_columns"])
+	}
+
+	forbiddenArgs := []map[string]string{
+		{"salary": "1000"},
+		{"_orderby": "salary"},
+		{"_select": "sum(salary)"},
+		{"_search": "a", "_search_columns": "notes"},
+	}
+	for _, myargs := range forbiddenArgs {
+		_, _, _, err = PolicyQuery(r, "policy_test", myargs)
+		if apiErr, ok := err.(*apierror.Error); !ok || apiErr.Status != http.StatusForbidden {
+			t.Errorf("PolicyQuery(%v) error = %v, want forbidden", myargs, err)
+		}
+	}
+	if _, _, _, err = PolicyQuery(r, "other", map[string]string{}); err == nil {
+		t.Errorf("PolicyQuery() on another table error = nil, want forbidden")
+	}
+
+	rows := []map[string]interface{}{{"id": 1, "name": "a"}}
+	if err = ApplyPolicyRows(r, "policy_test", rows, true); err != nil || rows[0]["owner_id"] != "42" {
+		t.Errorf("ApplyPolicyRows() = %v %v, want owner_id set", rows, err)
+	}
+	if err = ApplyPolicyRows(r, "policy_test", []map[string]interface{}{{"id": 1, "owner_id": "43"}}, false); err == nil {
+		t.Errorf("ApplyPolicyRows() with another owner error = nil, want forbidden")
+	}
+	if err = ApplyPolicyRows(r, "policy_test", []map[string]interface{}{{"id": 1, "salary": 10}}, false); err == nil {
+		t.Errorf("ApplyPolicyRows() with a denied column error = nil, want forbidden")
+	}
+
+	// Nested rows follow the policy of their own table
+	columns["policy_child"] = map[string]Column{
+		"id":       Column{Name: "id", Type: "integer"},
+		"owner_id": Column{Name: "owner_id", Type: "text"},
+	}
+	defer delete(columns, "policy_child")
+	child := map[string]interface{}{"id": 2}
+	rows = []map[string]interface{}{{"id": 1, "policy_child": child}}
+	if err = ApplyPolicyRows(r, "policy_test", rows, true); err == nil {
+		t.Errorf("ApplyPolicyRows() with nested rows and no nested policy error = nil, want forbidden")
+	}
+	policy.Nested = func(r *http.Request, tablename string, verb string) (Policy, error) {
+		if verb != http.MethodPost {
+			return Policy{}, forbidden("Verb " + verb + " is not allowed")
+		}
+		return Policy{Table: tablename, Filters: map[string]string{"owner_id": "7"}}, nil
+	}
+	r = WithPolicy(httptest.NewRequest("POST", "/policy_test", nil), policy)
+	if err = ApplyPolicyRows(r, "policy_test", rows, true); err != nil || child["owner_id"] != "7" {
+		t.Errorf("ApplyPolicyRows() = %v %v, want nested owner_id set", child, err)
+	}
+	if _, err = NestedRequest(r, "policy_child", http.MethodGet); err == nil {
+		t.Errorf("NestedRequest() with a verb not allowed error = nil, want forbidden")
+	}
+}
+
+func TestMask(t *testing.T) {
+	columns["mask_test"] = map[string]Column{
+		"id":         Column{Name: "id", Type: "integer"},
+		"email":      Column{Name: "email", Type: "text"},
+		"password":   Column{Name: "password", Type: "text"},
+		"created_at": Column{Name: "created_at", Type: "timestamp"},
+	}
+	defer delete(columns, "mask_test")
+	Masks = []config.MaskInfo{{Table: "mask_test", Hidden: []string{"password"}, ReadOnly: []string{"created_at"}, Masked: []string{"email"}, Privileged: []string{"admin"}}}
+	defer func() { Masks = nil }()
+
+	r := httptest.NewRequest("GET", "/mask_test", nil)
+	admin := r.WithContext(context.WithValue(r.Context(), "role", "admin"))
+
+	myselect, _, _, err := PolicyQuery(r, "mask_test", map[string]string{})
+	if err != nil {
+		t.Fatalf("PolicyQuery() error = %v", err)
+	}
+	if want := []string{`"created_at"`, `"email"`, `"id"`}; !reflect.DeepEqual(myselect, want) {
+		t.Errorf("PolicyQuery() select = %v, want %v", myselect, want)
+	}
+	forbiddenArgs := []map[string]string{
+		{"password": "a"},
+		{"email": "a"},
+		{"_orderby": "email"},
+		{"_select": "min(email)"},
+	}
+	for _, myargs := range forbiddenArgs {
+		_, _, _, err = PolicyQuery(r, "mask_test", myargs)
+		if apiErr, ok := err.(*apierror.Error); !ok || apiErr.Status != http.StatusForbidden {
+			t.Errorf("PolicyQuery(%v) error = %v, want forbidden", myargs, err)
+		}
+	}
+	if _, _, _, err = PolicyQuery(admin, "mask_test", map[string]string{"email": "a"}); err != nil {
+		t.Errorf("PolicyQuery() by privileged role error = %v, want nil", err)
+	}
+	if _, _, _, err = PolicyQuery(admin, "mask_test", map[string]string{"password": "a"}); err == nil {
+		t.Errorf("PolicyQuery() on hidden column by privileged role error = nil, want forbidden")
+	}
+
+	row := map[string]interface{}{"id": 1, "email": "a@b.c"}
+	MaskRow(r, "mask_test", row)
+	if row["email"] != MaskedValue {
+		t.Errorf("MaskRow() email = %v, want %v", row["email"], MaskedValue)
+	}
+	row = map[string]interface{}{"id": 1, "email": "a@b.c"}
+	MaskRow(admin, "mask_test", row)
+	if row["email"] != "a@b.c" {
+		t.Errorf("MaskRow() by privileged role email = %v, want a@b.c", row["email"])
+	}
+
+	if err = ApplyPolicyRows(r, "mask_test", []map[string]interface{}{{"email": "a@b.c", "created_at": "now"}}, true); err == nil {
+		t.Errorf("ApplyPolicyRows() with a read-only column error = nil, want forbidden")
+	}
+	if err = ApplyPolicyRows(r, "mask_test", []map[string]interface{}{{"email": "a@b.c", "password": "secret"}}, true); err != nil {
+		t.Errorf("ApplyPolicyRows() error = %v, want nil", err)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	Masks = []config.MaskInfo{{Table: "users", Hidden: []string{"password"}, Masked: []string{"email"}, Privileged: []string{"admin"}}}
+	defer func() {
+		Masks = nil
+		listeners = nil
+	}()
+
+	var events []Event
+	unsubscribe := Subscribe(func(r *http.Request, event Event) {
+		events = append(events, event)
+	})
+
+	req := httptest.NewRequest("POST", "/users", nil)
+	req = req.WithContext(context.WithValue(context.WithValue(req.Context(), "uuid", "42"), "role", "admin"))
+	publish(req, "users", OperationInsert, []map[string]interface{}{{"name": "alice", "password": "secret", "email": "alice@example.com"}})
+	publish(req, "users", OperationDelete, []map[string]interface{}{argsToRow(map[string]string{"name": "bob", "_limit": "1"})})
+
+	want := []map[string]interface{}{{"name": "alice", "email": MaskedValue}}
+	if len(events) != 2 || events[0].UUID != "42" || !reflect.DeepEqual(events[0].Rows, want) {
+		t.Errorf("publish() events = %v, want rows %v", events, want)
+	}
+	if want := []map[string]interface{}{{"name": "bob"}}; len(events) == 2 && !reflect.DeepEqual(events[1].Rows, want) {
+		t.Errorf("publish() delete rows = %v, want %v", events[1].Rows, want)
+	}
+
+	events = nil
+	tables = map[string]string{"users": "users", "accounts": "accounts"}
+	defer func() { tables = nil }()
+	Masks = append(Masks, config.MaskInfo{Table: "accounts", Hidden: []string{"token"}})
+	publishInsert(req, "users", []map[string]interface{}{{"name": "carol", "accounts": map[string]interface{}{"id": 1, "token": "secret"}}})
+	if len(events) != 2 || events[0].Table != "accounts" || events[1].Table != "users" {
+		t.Fatalf("publishInsert() events = %v, want an event on accounts then users", events)
+	}
+	if want := []map[string]interface{}{{"id": 1}}; !reflect.DeepEqual(events[0].Rows, want) {
+		t.Errorf("publishInsert() nested rows = %v, want %v", events[0].Rows, want)
+	}
+	if want := []map[string]interface{}{{"name": "carol"}}; !reflect.DeepEqual(events[1].Rows, want) {
+		t.Errorf("publishInsert() rows = %v, want %v", events[1].Rows, want)
+	}
+
+	events = nil
+	unsubscribe()
+	publish(req, "users", OperationUpdate, []map[string]interface{}{{"name": "dave"}})
+	if len(events) != 0 || len(listeners) != 0 {
+		t.Errorf("publish() after unsubscribe events = %v, want none", events)
+	}
+
+	if !MatchOperation(nil, OperationUpdate) || MatchOperation([]string{"insert"}, OperationDelete) {
+		t.Errorf("MatchOperation() does not match operations")
+	}
+}
+
+func TestStartQuery(t *testing.T) {
+	tracing.Enabled = true
+	tracing.Statements = true
+	defer func() { tracing.Enabled, tracing.Statements = false, false }()
+
+	ctx, parent := tracing.Start(context.Background(), "get_orders", tracing.KindServer)
+	r, q := startQuery(httptest.NewRequest("GET", "/orders", nil).WithContext(ctx), "orders", "select")
+	if tracing.FromContext(r.Context()) != q.span || q.span.ParentID != parent.Context.SpanID {
+		t.Fatalf("startQuery() span is not a child of the request span")
+	}
+	traceStatement(r, "SELECT * FROM orders")
+	q.count(2)
+	q.count(1)
+	q.end(nil)
+
+	attributes := q.span.Attributes()
+	if attributes["db.sql.table"] != "orders" || attributes["db.operation"] != "select" || attributes["db.rows"] != int64(3) ||
+		attributes["db.statement"] != "SELECT * FROM orders" {
+		t.Errorf("startQuery() span attributes = %v", attributes)
+	}
+	if metrics.QueryDuration.Count("orders", "select") != 1 {
+		t.Errorf("end() observed %v durations, want 1", metrics.QueryDuration.Count("orders", "select"))
+	}
+}
@@ -0,0 +1,144 @@
+package dbhelper
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations of generic writes
+const (
+	OperationInsert = "insert"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
+
+// Event describes rows written by a committed transaction
+// Rows hold inserted and updated values, or deleted rows, without hidden columns and with masked ones redacted
+type Event struct {
+	Table     string                   `json:"table"`
+	Operation string                   `json:"operation"`
+	Rows      []map[string]interface{} `json:"rows"`
+	UUID      string                   `json:"uuid,omitempty"`
+	Time      time.Time                `json:"time"`
+}
+
+// Listener is called after every committed generic write, it must not block
+type Listener func(r *http.Request, event Event)
+
+// A subscribed listener, compared by address to be unsubscribed
+type subscription struct {
+	listener Listener
+}
+
+var listenersMutex sync.RWMutex
+var listeners []*subscription
+
+// Subscribe calls a listener after every committed generic write, until the returned function is called
+func Subscribe(listener Listener) func() {
+	mysubscription := &subscription{listener: listener}
+
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+	listeners = append(listeners, mysubscription)
+
+	return func() {
+		listenersMutex.Lock()
+		defer listenersMutex.Unlock()
+		for i, item := range listeners {
+			if item == mysubscription {
+				listeners = append(listeners[:i:i], listeners[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// MatchOperation tells if an operation is among operations, every operation matches when they are empty or "*"
+func MatchOperation(operations []string, operation string) bool {
+	if len(operations) <= 0 {
+		return true
+	}
+	for _, myoperation := range operations {
+		if myoperation == "*" || strings.EqualFold(myoperation, operation) {
+			return true
+		}
+	}
+	return false
+}
+
+// Send an event to listeners once its transaction committed
+func publish(r *http.Request, tablename string, operation string, rows []map[string]interface{}) {
+	listenersMutex.RLock()
+	defer listenersMutex.RUnlock()
+	if len(listeners) <= 0 {
+		return
+	}
+
+	event := Event{Table: tablename, Operation: operation, Time: time.Now()}
+	if r != nil {
+		if uuid, ok := r.Context().Value("uuid").(string); ok {
+			event.UUID = uuid
+		}
+	}
+	for _, row := range rows {
+		myrow := map[string]interface{}{}
+		for key, value := range row {
+			if !IsHidden(tablename, key) {
+				myrow[key] = value
+			}
+		}
+		// Listeners send rows to third parties, whatever the role of the request
+		MaskRow(nil, tablename, myrow)
+		event.Rows = append(event.Rows, myrow)
+	}
+	for _, item := range listeners {
+		item.listener(r, event)
+	}
+}
+
+// Send events of inserted rows, nested rows of related tables being sent as inserts on their own table
+func publishInsert(r *http.Request, tablename string, rows []map[string]interface{}) {
+	listenersMutex.RLock()
+	nb := len(listeners)
+	listenersMutex.RUnlock()
+	if nb <= 0 {
+		return
+	}
+
+	var myrows []map[string]interface{}
+	var nestedRows = map[string][]map[string]interface{}{}
+	for _, row := range rows {
+		columns, nested, err := SplitNestedObjects(r, row)
+		if err != nil {
+			columns, nested = row, nil
+		}
+		myrows = append(myrows, columns)
+		for nestedtable, objects := range nested {
+			nestedRows[nestedtable] = append(nestedRows[nestedtable], objects...)
+		}
+	}
+
+	nestedtables := make([]string, 0, len(nestedRows))
+	for nestedtable := range nestedRows {
+		nestedtables = append(nestedtables, nestedtable)
+	}
+	sort.Strings(nestedtables)
+	for _, nestedtable := range nestedtables {
+		publishInsert(r, nestedtable, nestedRows[nestedtable])
+	}
+	publish(r, tablename, OperationInsert, myrows)
+}
+
+// Filters of a delete as the row they identify
+func argsToRow(args map[string]string) map[string]interface{} {
+	row := map[string]interface{}{}
+	for key, value := range args {
+		if !strings.HasPrefix(key, REQUEST_ARG_PREFIX) {
+			row[key] = value
+		}
+	}
+	return row
+}
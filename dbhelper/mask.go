@@ -0,0 +1,66 @@
+package dbhelper
+
+import (
+	"net/http"
+
+	"github.com/maxime1907/crudify/config"
+)
+
+// Masks configure hidden, read-only and masked columns of tables
+// Hidden columns are never selected, read-only columns cannot be written,
+// and masked columns are redacted unless the role of the request is privileged
+var Masks []config.MaskInfo
+
+// Value sent instead of masked columns
+var MaskedValue = "****"
+
+// GetMask returns the mask of a table, if any
+func GetMask(tablename string) *config.MaskInfo {
+	for i := range Masks {
+		if Masks[i].Table == tablename {
+			return &Masks[i]
+		}
+	}
+	return nil
+}
+
+// Role set on requests by authentication middlewares
+func requestRole(r *http.Request) string {
+	if r != nil {
+		if role, ok := r.Context().Value("role").(string); ok {
+			return role
+		}
+	}
+	return ""
+}
+
+// Privileged tells if the role of a request may read masked columns of a table
+func Privileged(r *http.Request, mask *config.MaskInfo) bool {
+	role := requestRole(r)
+	return role != "" && containsString(mask.Privileged, role)
+}
+
+// IsHidden tells if a column of a table is never selected
+func IsHidden(tablename string, column string) bool {
+	mask := GetMask(tablename)
+	return mask != nil && containsString(mask.Hidden, column)
+}
+
+// IsReadOnly tells if a column of a table cannot be written
+func IsReadOnly(tablename string, column string) bool {
+	mask := GetMask(tablename)
+	return mask != nil && containsString(mask.ReadOnly, column)
+}
+
+// MaskRow redacts masked columns of a row unless the role of the request is privileged
+func MaskRow(r *http.Request, tablename string, row map[string]interface{}) {
+	mask := GetMask(tablename)
+	if mask == nil || len(mask.Masked) <= 0 || Privileged(r, mask) {
+		return
+	}
+	for _, column := range mask.Masked {
+		if value, ok := row[column]; ok && value != nil {
+			row[column] = MaskedValue
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package dbhelper
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/maxime1907/crudify/apierror"
+)
+
+// Policy restricts the columns and rows of a table a request may use
+// Filters map columns to the only value rows may hold, they are added to every query
+// Nested resolves the policy of a nested table for a verb, nested objects are forbidden without it
+type Policy struct {
+	Table       string
+	Columns     []string
+	DenyColumns []string
+	Filters     map[string]string
+	Nested      func(r *http.Request, tablename string, verb string) (Policy, error)
+}
+
+func forbidden(message string) error {
+	return apierror.New(http.StatusForbidden, apierror.CodeForbidden, message)
+}
+
+// WithPolicy attaches a policy to a request
+func WithPolicy(r *http.Request, policy Policy) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), "policy", policy))
+}
+
+// GetPolicy returns the policy attached to a request, if any
+func GetPolicy(r *http.Request) (Policy, bool) {
+	if r == nil {
+		return Policy{}, false
+	}
+	policy, ok := r.Context().Value("policy").(Policy)
+	return policy, ok
+}
+
+// NestedRequest returns the request with the policy of a nested table attached
+func NestedRequest(r *http.Request, tablename string, verb string) (*http.Request, error) {
+	policy, ok := GetPolicy(r)
+	if !ok || policy.Table == tablename {
+		return r, nil
+	}
+	if policy.Nested == nil {
+		return nil, forbidden("Nested objects are not allowed by policy")
+	}
+	nestedPolicy, err := policy.Nested(r, tablename, verb)
+	if err != nil {
+		return nil, err
+	}
+	return WithPolicy(r, nestedPolicy), nil
+}
+
+// AllowedColumns returns the columns of a table a policy allows
+func (p Policy) AllowedColumns(tablecolumns map[string]Column) map[string]Column {
+	allowed := map[string]Column{}
+	for name, column := range tablecolumns {
+		if p.Allows(name) {
+			allowed[name] = column
+		}
+	}
+	return allowed
+}
+
+// Allows tells if a policy allows a column
+func (p Policy) Allows(column string) bool {
+	if len(p.Columns) > 0 && !containsString(p.Columns, column) {
+		return false
+	}
+	return !containsString(p.DenyColumns, column)
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the policy of a request with the columns it may select, and the columns it may filter on,
+// an error if the policy does not apply to the table
+// Nothing is returned when neither a policy nor a mask restricts the table
+func requestPolicy(r *http.Request, tablename string) (*Policy, map[string]Column, map[string]Column, map[string]Column, error) {
+	policy, ok := GetPolicy(r)
+	if ok && policy.Table != tablename {
+		return nil, nil, nil, nil, forbidden("Policy of table " + policy.Table + " does not allow access to table " + tablename)
+	}
+	mask := GetMask(tablename)
+	if !ok && mask == nil {
+		return nil, nil, nil, nil, nil
+	}
+	tablecolumns, err := GetColumns(r, tablename)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	allowed := tablecolumns
+	if ok {
+		allowed = policy.AllowedColumns(tablecolumns)
+	} else {
+		policy = Policy{Table: tablename}
+	}
+	if mask == nil {
+		return &policy, tablecolumns, allowed, allowed, nil
+	}
+
+	// Masked columns are selected redacted, filtering on them would reveal their value
+	selectable := map[string]Column{}
+	filterable := map[string]Column{}
+	privileged := Privileged(r, mask)
+	for name, column := range allowed {
+		if containsString(mask.Hidden, name) {
+			continue
+		}
+		selectable[name] = column
+		if privileged || !containsString(mask.Masked, name) {
+			filterable[name] = column
+		}
+	}
+	return &policy, tablecolumns, selectable, filterable, nil
+}
+
+// Check that filters of query arguments only use allowed columns
+func checkPolicyArgs(tablecolumns map[string]Column, allowed map[string]Column, args map[string]string) error {
+	for key := range args {
+		if strings.HasPrefix(key, REQUEST_ARG_PREFIX) {
+			continue
+		}
+		if _, ok := tablecolumns[key]; ok {
+			if _, ok = allowed[key]; !ok {
+				return forbidden("Column " + key + " is not allowed")
+			}
+		}
+	}
+	return nil
+}
+
+// Get mandatory filters of a policy as where statements
+func policyWhere(policy *Policy) []Builder {
+	var where []Builder
+	var keys []string
+
+	for key := range policy.Filters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		where = append(where, Builder{Column: key, Value: policy.Filters[key], Operand: "="})
+	}
+	return where
+}
+
+// PolicyQuery returns selected columns, where statements and arguments of a select restricted by the policy of a request
+// and the mask of the table
+func PolicyQuery(r *http.Request, tablename string, args map[string]string) ([]string, []Builder, map[string]string, error) {
+	policy, tablecolumns, selectable, allowed, err := requestPolicy(r, tablename)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if policy == nil {
+		return []string{"*"}, []Builder{}, args, nil
+	}
+	if err = checkPolicyArgs(tablecolumns, allowed, args); err != nil {
+		return nil, nil, nil, err
+	}
+
+	myargs := map[string]string{}
+	for key, value := range args {
+		myargs[key] = value
+	}
+	if val, ok := args[REQUEST_ARG_PREFIX+"orderby"]; ok && val != REQUEST_ARG_PREFIX+"rank" {
+		if _, ok = allowed[val]; !ok {
+			return nil, nil, nil, forbidden("Order by column " + val + " is not allowed")
+		}
+	}
+	if val, ok := args[REQUEST_ARG_PREFIX+"select"]; ok {
+		if _, _, err = ParseSelect(selectable, val); err == nil {
+			// Grouping on a masked column selects it redacted, aggregating it would not
+			for _, item := range strings.Split(val, ",") {
+				if item = strings.TrimSpace(item); strings.Contains(item, "(") {
+					if _, _, err = ParseAggregate(allowed, item); err != nil {
+						break
+					}
+				}
+			}
+		}
+		if err != nil {
+			if _, _, err2 := ParseSelect(tablecolumns, val); err2 == nil {
+				return nil, nil, nil, forbidden("Select argument uses columns that are not allowed")
+			}
+			return nil, nil, nil, err
+		}
+	}
+	if val, ok := args[REQUEST_ARG_PREFIX+"having"]; ok {
+		if _, _, err = ParseHaving(allowed, val); err != nil {
+			if _, _, err2 := ParseHaving(tablecolumns, val); err2 == nil {
+				return nil, nil, nil, forbidden("Having argument uses columns that are not allowed")
+			}
+			return nil, nil, nil, err
+		}
+	}
+	if _, ok := args[REQUEST_ARG_PREFIX+"search"]; ok {
+		names, err := ParseSearchColumns(allowed, args[REQUEST_ARG_PREFIX+"search_columns"])
+		if err != nil {
+			if _, err2 := ParseSearchColumns(tablecolumns, args[REQUEST_ARG_PREFIX+"search_columns"]); err2 == nil {
+				return nil, nil, nil, forbidden("Search columns are not allowed")
+			}
+			return nil, nil, nil, err
+		}
+		// Searching every text column would match on denied ones
+		myargs[REQUEST_ARG_PREFIX+"search_columns"] = strings.Join(names, ",")
+	}
+
+	var myselect []string
+	for name := range selectable {
+		myselect = append(myselect, quoteIdent(name))
+	}
+	if len(myselect) <= 0 {
+		return nil, nil, nil, forbidden("No column of table " + tablename + " is allowed")
+	}
+	sort.Strings(myselect)
+	return myselect, policyWhere(policy), myargs, nil
+}
+
+// ApplyPolicyRows checks that rows only write allowed columns which are not read-only, with the values of mandatory filters
+// which are set on inserted rows missing them, then checks nested rows against the policy of their own table
+func ApplyPolicyRows(r *http.Request, tablename string, rows []map[string]interface{}, insert bool) error {
+	_, hasPolicy := GetPolicy(r)
+	policy, tablecolumns, _, _, err := requestPolicy(r, tablename)
+	if err != nil {
+		return err
+	}
+	var allowed map[string]Column
+	var primaryKeys []string
+	if policy != nil {
+		allowed = policy.AllowedColumns(tablecolumns)
+		if mask := GetMask(tablename); !insert && mask != nil && len(mask.ReadOnly) > 0 {
+			// Primary keys of updated rows locate them and are not written
+			primaryKeys, err = GetPrimaryKeys(r, tablename)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, row := range rows {
+		for key, value := range row {
+			if policy == nil {
+				if objects, err := toObjects(value); err == nil && insert {
+					if err = ApplyPolicyRows(r, key, objects, insert); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if _, ok := tablecolumns[key]; !ok {
+				switch value.(type) {
+				case map[string]interface{}, []interface{}:
+					if hasPolicy && !insert {
+						return forbidden("Nested objects are not allowed by policy")
+					}
+					if objects, err := toObjects(value); err == nil && insert {
+						nestedRequest, err := NestedRequest(r, key, http.MethodPost)
+						if err != nil {
+							return err
+						}
+						if err = ApplyPolicyRows(nestedRequest, key, objects, insert); err != nil {
+							return err
+						}
+					}
+				}
+				continue
+			}
+			if _, ok := allowed[key]; !ok {
+				return forbidden("Column " + key + " is not writable")
+			}
+			if IsReadOnly(tablename, key) && !containsString(primaryKeys, key) {
+				return forbidden("Column " + key + " is read-only")
+			}
+			if filter, ok := policy.Filters[key]; ok && fmt.Sprintf("%v", value) != filter {
+				return forbidden("Column " + key + " should be " + filter)
+			}
+		}
+		if insert && policy != nil {
+			for key, filter := range policy.Filters {
+				if _, ok := row[key]; !ok {
+					row[key] = filter
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PolicyFilters checks filters of a delete and returns the mandatory filters of the policy of a request
+func PolicyFilters(r *http.Request, tablename string, args map[string]string) (map[string]string, error) {
+	policy, tablecolumns, _, allowed, err := requestPolicy(r, tablename)
+	if err != nil || policy == nil {
+		return nil, err
+	}
+	if err = checkPolicyArgs(tablecolumns, allowed, args); err != nil {
+		return nil, err
+	}
+	return policy.Filters, nil
+}
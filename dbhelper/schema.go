@@ -0,0 +1,182 @@
+package dbhelper
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/logger"
+	"github.com/maxime1907/crudify/metrics"
+)
+
+// Column holds the metadata of a table column
+type Column struct {
+	Name       string
+	Type       string
+	UdtName    string
+	Nullable   bool
+	HasDefault bool
+	MaxLength  int
+	Enum       []string
+}
+
+// Global variable that holds columns of each table, filled on first use
+var columns = map[string]map[string]Column{}
+var columnsMutex sync.RWMutex
+
+// Global variable that holds labels of each enum type, filled on first use
+var enums map[string][]string
+var enumsMutex sync.Mutex
+
+// Global variable that holds primary keys of each table, filled on first use
+var primaryKeys = map[string][]string{}
+var primaryKeysMutex sync.RWMutex
+
+var numericTypes = map[string]bool{
+	"smallint":         true,
+	"integer":          true,
+	"bigint":           true,
+	"numeric":          true,
+	"decimal":          true,
+	"real":             true,
+	"double precision": true,
+	"money":            true,
+}
+
+var textTypes = map[string]bool{
+	"text":              true,
+	"character varying": true,
+	"character":         true,
+	"citext":            true,
+}
+
+// IsText tells if a column holds text
+func (c Column) IsText() bool {
+	return textTypes[c.Type] || textTypes[c.UdtName]
+}
+
+// IsNumeric tells if a column holds numbers
+func (c Column) IsNumeric() bool {
+	return numericTypes[c.Type]
+}
+
+// Get columns of a table from sql database
+func GetColumns(r *http.Request, tablename string) (map[string]Column, error) {
+	columnsMutex.RLock()
+	tablecolumns, ok := columns[tablename]
+	columnsMutex.RUnlock()
+	if ok {
+		return tablecolumns, nil
+	}
+
+	logger.Log(r).Debug().Msg("Getting columns of table: " + tablename)
+
+	var myselect = []string{
+		"column_name",
+		"data_type",
+		"udt_name",
+		"is_nullable",
+		"column_default",
+		"character_maximum_length",
+	}
+	var where = []Builder{
+		Builder{"table_schema", "public", "="},
+		Builder{"table_name", tablename, "="},
+	}
+	res, err := SelectWithQuery(r, myselect, "information_schema.columns", map[string]string{}, where)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil || len(*res) <= 0 {
+		return nil, apierror.New(http.StatusNotFound, apierror.CodeUndefinedTable, "sql: no rows in result set for table " + tablename).WithTable(tablename)
+	}
+
+	tableenums, err := GetEnums(r)
+	if err != nil {
+		return nil, err
+	}
+
+	tablecolumns = map[string]Column{}
+	for _, row := range *res {
+		column := Column{
+			Name:       fmt.Sprintf("%v", row["column_name"]),
+			Type:       fmt.Sprintf("%v", row["data_type"]),
+			UdtName:    fmt.Sprintf("%v", row["udt_name"]),
+			Nullable:   row["is_nullable"] == "YES",
+			HasDefault: row["column_default"] != nil,
+		}
+		if length, ok := row["character_maximum_length"].(string); ok {
+			column.MaxLength, _ = strconv.Atoi(length)
+		}
+		if column.Type == "USER-DEFINED" {
+			column.Enum = tableenums[column.UdtName]
+		}
+		tablecolumns[column.Name] = column
+	}
+
+	columnsMutex.Lock()
+	columns[tablename] = tablecolumns
+	columnsMutex.Unlock()
+	metrics.SchemaReloads.Inc("columns")
+	return tablecolumns, nil
+}
+
+// Get primary key columns of a table from sql database
+func GetPrimaryKeys(r *http.Request, tablename string) ([]string, error) {
+	primaryKeysMutex.RLock()
+	keys, ok := primaryKeys[tablename]
+	primaryKeysMutex.RUnlock()
+	if ok {
+		return keys, nil
+	}
+
+	res, err := SelectPrimaryKeys(r, tablename)
+	if err != nil {
+		return nil, err
+	}
+	keys = make([]string, 0, len(*res))
+	for _, row := range *res {
+		keys = append(keys, fmt.Sprintf("%v", row["attname"]))
+	}
+	sort.Strings(keys)
+
+	primaryKeysMutex.Lock()
+	primaryKeys[tablename] = keys
+	primaryKeysMutex.Unlock()
+	metrics.SchemaReloads.Inc("primary_keys")
+	return keys, nil
+}
+
+// Get labels of every enum type from sql database
+func GetEnums(r *http.Request) (map[string][]string, error) {
+	enumsMutex.Lock()
+	defer enumsMutex.Unlock()
+	if enums != nil {
+		return enums, nil
+	}
+
+	logger.Log(r).Debug().Msg("Getting enum types from database")
+
+	var myselect = []string{
+		"pg_type.typname",
+		"pg_enum.enumlabel",
+	}
+	var from = "pg_type JOIN pg_enum ON pg_type.oid = pg_enum.enumtypid"
+	var args = map[string]string{
+		REQUEST_ARG_PREFIX + "orderby": "pg_enum.enumsortorder",
+	}
+	res, err := SelectWithQuery(r, myselect, from, args, []Builder{})
+	if err != nil {
+		return nil, err
+	}
+	enums = map[string][]string{}
+	for _, row := range *res {
+		typname := fmt.Sprintf("%v", row["typname"])
+		enums[typname] = append(enums[typname], fmt.Sprintf("%v", row["enumlabel"]))
+	}
+	metrics.SchemaReloads.Inc("enums")
+	return enums, nil
+}
@@ -0,0 +1,111 @@
+package dbhelper
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"sort"
+
+	"github.com/gocraft/dbr"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Session is applied at the start of every transaction of a request,
+// so that row-level security policies of the database authorize queries
+type Session struct {
+	Role     string
+	Settings map[string]string
+}
+
+// WithSession attaches a session to a request
+func WithSession(r *http.Request, session Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), "session", session))
+}
+
+// GetSession returns the session attached to a request, if any
+func GetSession(r *http.Request) (Session, bool) {
+	if r == nil {
+		return Session{}, false
+	}
+	session, ok := r.Context().Value("session").(Session)
+	return session, ok
+}
+
+// Begin starts a transaction with the session of the request applied
+func Begin(r *http.Request) (*dbr.Tx, error) {
+	if GetConnection() == nil {
+		return nil, errNotConnected()
+	}
+	tx, err := connection.NewSession(nil).Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = applySession(r, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// Switch role and set settings for the rest of the transaction only
+func applySession(r *http.Request, tx *dbr.Tx) error {
+	session, ok := GetSession(r)
+	if !ok {
+		return nil
+	}
+	if session.Role != "" {
+		logger.Log(r).Debug().Msg("Setting role of transaction: " + session.Role)
+		if _, err := tx.Exec("SET LOCAL ROLE " + quoteIdent(session.Role)); err != nil {
+			return err
+		}
+	}
+	var keys []string
+	for key := range session.Settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		logger.Log(r).Debug().Msg("Setting configuration of transaction: " + key)
+		if _, err := tx.Exec("SELECT set_config($1, $2, true)", key, session.Settings[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryRows executes a read query and passes its rows to fn,
+// inside a transaction when the request has a session
+func QueryRows(r *http.Request, query string, fn func(rows *sql.Rows) error) error {
+	if GetConnection() == nil {
+		return errNotConnected()
+	}
+	logger.Log(r).Debug().Msg("Executing on database query => " + query)
+	traceStatement(r, query)
+
+	if _, ok := GetSession(r); !ok {
+		rows, err := connection.DB.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		return fn(rows)
+	}
+
+	tx, err := Begin(r)
+	if err != nil {
+		return err
+	}
+	defer tx.RollbackUnlessCommitted()
+
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	err = fn(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/json-iterator/go"
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Content types negotiated on generic routes
+const (
+	ContentTypeJSON    = "application/json"
+	ContentTypeNDJSON  = "application/x-ndjson"
+	ContentTypeCSV     = "text/csv"
+	ContentTypeProblem = "application/problem+json"
+)
+
+// Stream format of each negotiated content type, JSON is answered without streaming
+var contentTypeFormats = map[string]string{
+	ContentTypeJSON:   "",
+	"*/*":             "",
+	ContentTypeNDJSON: StreamNDJSON,
+	ContentTypeCSV:    StreamCSV,
+}
+
+// NegotiateFormat returns the stream format preferred by the Accept header, empty for JSON
+func NegotiateFormat(r *http.Request) string {
+	var format string
+	var best float64 = -1
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		myformat, ok := contentTypeFormats[mediatype]
+		if !ok {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil || quality <= 0 {
+				// A zero quality marks the type as not acceptable
+				continue
+			}
+		}
+		if quality > best {
+			best = quality
+			format = myformat
+		}
+	}
+	return format
+}
+
+// AcceptsProblem tells if the Accept header asks for errors as problem details
+func AcceptsProblem(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediatype, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil || mediatype != ContentTypeProblem {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			quality, err := strconv.ParseFloat(q, 64)
+			if err != nil || quality <= 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// DecodeBody parses body as JSON, NDJSON or CSV according to its Content-Type
+func DecodeBody(r *http.Request) (*[]map[string]interface{}, error) {
+	if r == nil || r.Body == nil {
+		return nil, apierror.New(http.StatusBadRequest, apierror.CodeInvalidBody, "HTTP body does not exist")
+	}
+	var data *[]map[string]interface{}
+	var err error
+
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediatype {
+	case ContentTypeNDJSON:
+		data, err = DecodeNDJSON(r)
+	case ContentTypeCSV:
+		data, err = DecodeCSV(r)
+	default:
+		data, err = DecodeJSON(r)
+	}
+	if err != nil {
+		return nil, apierror.New(http.StatusBadRequest, apierror.CodeInvalidBody, err.Error())
+	}
+	return data, nil
+}
+
+// DecodeNDJSON parses a body holding one JSON object per line
+func DecodeNDJSON(r *http.Request) (*[]map[string]interface{}, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	var data []map[string]interface{}
+	var line int
+
+	logger.Log(r).Debug().Msg("Parsing body as a NDJSON")
+
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var row map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return nil, errors.New("Line " + strconv.Itoa(line) + ": " + err.Error())
+		}
+		data = append(data, row)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// DecodeCSV parses a body whose header row holds column names, empty fields are null
+func DecodeCSV(r *http.Request) (*[]map[string]interface{}, error) {
+	var data []map[string]interface{}
+
+	logger.Log(r).Debug().Msg("Parsing body as a CSV")
+
+	reader := csv.NewReader(r.Body)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return &data, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+		if header[i] == "" {
+			return nil, errors.New("CSV header has an empty column name at position " + strconv.Itoa(i+1))
+		}
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		row := make(map[string]interface{}, len(header))
+		for i, column := range header {
+			if record[i] == "" {
+				row[column] = nil
+			} else {
+				row[column] = record[i]
+			}
+		}
+		data = append(data, row)
+	}
+	return &data, nil
+}
@@ -1,32 +1,34 @@
 package handler
 
 import (
-	"crypto/tls"
-	"net/smtp"
-	"net/mail"
 	"bytes"
 	"errors"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
-	"fmt"
 	"golang.org/x/crypto/bcrypt"
 
 	"github.com/gorilla/mux"
 	"github.com/json-iterator/go"
+	"github.com/maxime1907/crudify/apierror"
 	"github.com/maxime1907/crudify/dbhelper"
 	"github.com/maxime1907/crudify/logger"
 	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/notify"
 )
 
 type Response struct {
-	Uuid    string      `json:"uuid"`
-	Time    time.Time   `json:"time"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data"`
+	Uuid    string          `json:"uuid"`
+	Time    time.Time       `json:"time"`
+	Message string          `json:"message"`
+	Data    interface{}     `json:"data"`
+	Error   *apierror.Error `json:"error,omitempty"`
 }
 
+// Format of answers, errors are also sent as problem details when the Accept header asks for them
+var Responses config.ResponseInfo
+
 func VerifyHash(plainContent string, hashedContent string) error {
 	myPlainContent := []byte(plainContent)
     byteHash := []byte(hashedContent)
@@ -36,7 +38,7 @@ func VerifyHash(plainContent string, hashedContent string) error {
 
 func HashAndSalt(content string) (string, error) {
 	myContent := []byte(content)
-    hash, err := bcrypt.GenerateFromPassword(myContent, bcrypt.MinCost)
+    hash, err := bcrypt.GenerateFromPassword(myContent, bcrypt.DefaultCost)
     return string(hash), err
 }
 
@@ -44,6 +46,9 @@ func HashAndSalt(content string) (string, error) {
 func GetStatusCode(r *http.Request, er error) int {
 	logger.Log(r).Debug().Msg("Getting status code by error")
 	if er != nil {
+		if apiErr, ok := dbhelper.DatabaseError(er).(*apierror.Error); ok {
+			return apiErr.Status
+		}
 		var erStr = er.Error()
 		if strings.Contains(erStr, "sql: no rows in result set") {
 			return http.StatusNotFound
@@ -64,22 +69,48 @@ func SendAnswer(w http.ResponseWriter, r *http.Request, data interface{}, er err
 	var statuscode int = GetStatusCode(r, er)
 	var myuuid string
 	var msg string
+	var apiErr *apierror.Error
 
 	logger.Log(r).Debug().Msg("Sending HTTP answer with status code " + strconv.Itoa(statuscode))
 
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(statuscode)
 	if er != nil {
 		msg = er.Error()
+		apiErr = apierror.From(dbhelper.DatabaseError(er), statuscode)
+		if Responses.Problem || AcceptsProblem(r) {
+			return SendProblem(w, r, apiErr)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(statuscode)
+	if er == nil && Responses.Bare {
+		return EncodeJSON(w, r, data)
+	}
+	myuuid = GetUUID(r)
+	res := Response{Uuid: myuuid, Time: time.Now(), Message: msg, Data: data, Error: apiErr}
+	err := EncodeJSON(w, r, res)
+	return err
+}
+
+// Sends an error as RFC 7807 problem details, the request uuid is its instance
+func SendProblem(w http.ResponseWriter, r *http.Request, apiErr *apierror.Error) error {
+	var instance string
+
+	if myuuid := GetUUID(r); myuuid != "" {
+		instance = "urn:uuid:" + myuuid
 	}
+	w.Header().Set("Content-Type", ContentTypeProblem)
+	w.WriteHeader(apiErr.Status)
+	return EncodeJSON(w, r, apiErr.Problem(Responses.ProblemType, instance))
+}
+
+// Get the uuid given to the request by the logger
+func GetUUID(r *http.Request) string {
 	if r != nil {
 		if myuuidVal := r.Context().Value("uuid"); myuuidVal != nil {
-			myuuid = myuuidVal.(string)
+			return myuuidVal.(string)
 		}
 	}
-	res := Response{Uuid: myuuid, Time: time.Now(), Message: msg, Data: data}
-	err := EncodeJSON(w, r, res)
-	return err
+	return ""
 }
 
 // Get route parameters
@@ -112,6 +143,15 @@ func FormToMap(r *http.Request) map[string]string {
 	return mymap
 }
 
+// Get query arguments along with route parameters, which filter on columns of the same name
+func GetArgs(r *http.Request) map[string]string {
+	args := FormToMap(r)
+	for key, value := range Vars(r) {
+		args[key] = value
+	}
+	return args
+}
+
 func CheckProperties(data map[string]interface{}, properties []string) error {
 	for i := 0; i < len(properties); i++ {
 		if _, ok := data[properties[i]]; !ok {
@@ -121,83 +161,9 @@ func CheckProperties(data map[string]interface{}, properties []string) error {
 	return nil
 }
 
+// SendEmail sends a plain text email through the configured SMTP server
 func SendEmail(smtpConfig config.SMTPInfo, email string, title string, body string) error {
-	ownerMail := smtpConfig.OwnerEmail
-	password := smtpConfig.Password
-
-	// Connect to the SMTP Server
-	servername := smtpConfig.Host
-	serverport := fmt.Sprintf("%v", smtpConfig.Port)
-
-	from := mail.Address{"", ownerMail}
-    to   := mail.Address{"", email }
-
-    // Setup headers
-    headers := make(map[string]string)
-    headers["From"] = from.String()
-    headers["To"] = to.String()
-    headers["Subject"] = title
-
-    // Setup message
-    message := ""
-    for k,v := range headers {
-        message += fmt.Sprintf("%s: %s\r\n", k, v)
-    }
-    message += "\r\n" + body
-
-	auth := smtp.PlainAuth(
-		"",
-		ownerMail,
-		password,
-		servername,
-	)
-
-    // TLS config
-    tlsconfig := &tls.Config {
-        InsecureSkipVerify: false,
-        ServerName: servername,
-    }
-
-    c, err := smtp.Dial(servername + ":" + serverport)
-    if err != nil {
-        return err
-    }
-
-    c.StartTLS(tlsconfig)
-
-    // Auth
-    if err = c.Auth(auth); err != nil {
-        return err
-    }
-
-    // To && From
-    if err = c.Mail(from.Address); err != nil {
-        return err
-    }
-
-    if err = c.Rcpt(to.Address); err != nil {
-        return err
-    }
-
-    // Data
-    w, err := c.Data()
-    if err != nil {
-        return err
-    }
-
-    _, err = w.Write([]byte(message))
-    if err != nil {
-        return err
-    }
-
-    err = w.Close()
-    if err != nil {
-        return err
-    }
-
-	c.Quit()
-
-	return nil
+	return notify.Send(smtpConfig, notify.Message{To: []string{email}, Subject: title, Text: body})
 }
 
 func EncodeJSON(w http.ResponseWriter, r *http.Request, res interface{}) error {
@@ -236,8 +202,17 @@ func DecodeJSON(r *http.Request) (*[]map[string]interface{}, error) {
 
 // Generic get
 func Get(w http.ResponseWriter, r *http.Request) {
-	args := FormToMap(r)
+	args := GetArgs(r)
 	tablename := GetTableName(r)
+	format, ok := args[dbhelper.REQUEST_ARG_PREFIX + "stream"]
+	if !ok {
+		format = NegotiateFormat(r)
+		ok = format != ""
+	}
+	if ok {
+		StreamGet(w, r, tablename, args, format)
+		return
+	}
 	result, err := dbhelper.Select(r, tablename, args)
 	if err != nil {
 		logger.Log(r).Warn().Msg(err.Error())
@@ -252,9 +227,12 @@ func Get(w http.ResponseWriter, r *http.Request) {
 func Post(w http.ResponseWriter, r *http.Request) {
 	var result *[]map[string]interface{}
 
-	args := FormToMap(r)
+	args := GetArgs(r)
 	tablename := GetTableName(r)
-	data, err := DecodeJSON(r)
+	data, err := DecodeBody(r)
+	if err == nil {
+		err = ValidateBody(r, tablename, *data, true)
+	}
 	if err == nil {
 		result, err = dbhelper.Insert(r, tablename, args, *data)
 	}
@@ -269,10 +247,19 @@ func Post(w http.ResponseWriter, r *http.Request) {
 
 // Generic put
 func Put(w http.ResponseWriter, r *http.Request) {
-	args := FormToMap(r)
+	args := GetArgs(r)
 	tablename := GetTableName(r)
-	data, err := DecodeJSON(r)
+	data, err := DecodeBody(r)
 	if err == nil {
+		err = ValidateBody(r, tablename, *data, false)
+	}
+	if err == nil {
+		// Primary keys given in route apply to every row
+		for key, value := range Vars(r) {
+			for _, row := range *data {
+				row[key] = value
+			}
+		}
 		err = dbhelper.Update(r, tablename, args, *data)
 	}
 	if err != nil {
@@ -286,7 +273,7 @@ func Put(w http.ResponseWriter, r *http.Request) {
 
 // Generic delete
 func Delete(w http.ResponseWriter, r *http.Request) {
-	args := FormToMap(r)
+	args := GetArgs(r)
 	tablename := GetTableName(r)
 	err := dbhelper.Delete(r, tablename, args)
 	if err != nil {
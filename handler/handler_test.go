@@ -5,7 +5,13 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
 )
 
 func TestGetStatusCode(t *testing.T) {
@@ -145,3 +151,329 @@ func TestGetTableName(t *testing.T) {
 		})
 	}
 }
+
+func TestRowStreamer(t *testing.T) {
+	type args struct {
+		format  string
+		columns []string
+		rows    []map[string]interface{}
+		er      error
+	}
+	tests := []struct {
+		name    string
+		args    args
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "JSON stream",
+			args: args{
+				format: StreamJSON,
+				rows:   []map[string]interface{}{{"id": "1"}, {"id": "2"}},
+			},
+			want: `"data":[{"id":"1"}` + "\n" + `,{"id":"2"}` + "\n" + `],"message":""}` + "\n",
+		},
+		{
+			name: "JSON stream failing mid-stream",
+			args: args{
+				format: StreamJSON,
+				rows:   []map[string]interface{}{{"id": "1"}},
+				er:     errors.New("connection reset"),
+			},
+			want: `"data":[{"id":"1"}` + "\n" + `],"message":"connection reset"}` + "\n",
+		},
+		{
+			name: "NDJSON stream",
+			args: args{
+				format: StreamNDJSON,
+				rows:   []map[string]interface{}{{"id": "1"}, {"id": "2"}},
+			},
+			want: `{"id":"1"}` + "\n" + `{"id":"2"}` + "\n",
+		},
+		{
+			name: "CSV stream",
+			args: args{
+				format:  StreamCSV,
+				columns: []string{"id", "name", "description"},
+				rows:    []map[string]interface{}{{"id": "1", "name": "a, b", "description": nil}},
+			},
+			want: "id,name,description\n1,\"a, b\",\n",
+		},
+		{
+			name: "Unknown format",
+			args: args{
+				format: "xml",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			streamer, err := NewRowStreamer(w, nil, tt.args.format, tt.args.columns)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewRowStreamer() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err != nil {
+				return
+			}
+			for _, row := range tt.args.rows {
+				if err = streamer.WriteRow(row); err != nil {
+					t.Errorf("WriteRow() error = %v", err)
+				}
+			}
+			if err = streamer.Close(tt.args.er); err != nil {
+				t.Errorf("Close() error = %v", err)
+			}
+			if got := w.Body.String(); !strings.HasSuffix(got, tt.want) {
+				t.Errorf("RowStreamer body = %v, want suffix %v", got, tt.want)
+			}
+			if tt.args.er != nil && w.Header().Get(StreamErrorTrailer) != tt.args.er.Error() {
+				t.Errorf("RowStreamer trailer = %v, want %v", w.Header().Get(StreamErrorTrailer), tt.args.er.Error())
+			}
+		})
+	}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{
+			name:   "No Accept header",
+			accept: "",
+			want:   "",
+		},
+		{
+			name:   "CSV",
+			accept: "text/csv",
+			want:   StreamCSV,
+		},
+		{
+			name:   "NDJSON preferred over JSON",
+			accept: "application/json;q=0.5, application/x-ndjson",
+			want:   StreamNDJSON,
+		},
+		{
+			name:   "JSON preferred over CSV",
+			accept: "text/csv;q=0.1, application/json",
+			want:   "",
+		},
+		{
+			name:   "CSV not acceptable",
+			accept: "text/csv;q=0",
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.Header.Set("Accept", tt.accept)
+			if got := NegotiateFormat(req); got != tt.want {
+				t.Errorf("NegotiateFormat() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        []map[string]interface{}
+		wantErr     bool
+	}{
+		{
+			name:        "JSON",
+			contentType: "application/json",
+			body:        `[{"id": "1"}, {"id": "2"}]`,
+			want:        []map[string]interface{}{{"id": "1"}, {"id": "2"}},
+		},
+		{
+			name:        "NDJSON",
+			contentType: "application/x-ndjson",
+			body:        "{\"id\": \"1\"}\n\n{\"id\": \"2\"}\n",
+			want:        []map[string]interface{}{{"id": "1"}, {"id": "2"}},
+		},
+		{
+			name:        "CSV",
+			contentType: "text/csv; charset=UTF-8",
+			body:        "id,name\n1,\"a, b\"\n2,\n",
+			want:        []map[string]interface{}{{"id": "1", "name": "a, b"}, {"id": "2", "name": nil}},
+		},
+		{
+			name:        "CSV with missing fields",
+			contentType: "text/csv",
+			body:        "id,name\n1\n",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/test", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			got, err := DecodeBody(req)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("DecodeBody() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("DecodeBody() = %v, want %v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRow(t *testing.T) {
+	tablecolumns := map[string]dbhelper.Column{
+		"id":     {Name: "id", Type: "integer"},
+		"name":   {Name: "name", Type: "character varying", MaxLength: 5},
+		"admin":  {Name: "admin", Type: "boolean", HasDefault: true},
+		"status": {Name: "status", Type: "USER-DEFINED", Nullable: true, Enum: []string{"open", "closed"}},
+		"rank":   {Name: "rank", Type: "smallint", Nullable: true},
+		"total":  {Name: "total", Type: "bigint", Nullable: true},
+		"price":  {Name: "price", Type: "money", Nullable: true},
+	}
+	type args struct {
+		row    map[string]interface{}
+		insert bool
+		filled map[string]bool
+	}
+	tests := []struct {
+		name string
+		args args
+		want []string
+	}{
+		{
+			name: "Valid insert",
+			args: args{
+				row:    map[string]interface{}{"id": "-1", "name": "test", "admin": true, "status": nil},
+				insert: true,
+			},
+		},
+		{
+			name: "Invalid values",
+			args: args{
+				row:    map[string]interface{}{"id": 1.5, "name": "too long", "admin": "maybe", "status": "pending", "unknown": 1},
+				insert: true,
+			},
+			want: []string{"admin", "id", "name", "status", "unknown"},
+		},
+		{
+			name: "Integers within bounds and money values",
+			args: args{
+				row:    map[string]interface{}{"id": -2147483648.0, "rank": "32767", "total": "-9223372036854775808", "price": 12.5},
+				insert: false,
+			},
+		},
+		{
+			name: "Integers out of bounds and invalid money",
+			args: args{
+				row:    map[string]interface{}{"id": 2147483648.0, "rank": "40000", "total": 9223372036854775808.0, "price": true},
+				insert: false,
+			},
+			want: []string{"id", "price", "rank", "total"},
+		},
+		{
+			name: "Missing required columns on insert",
+			args: args{
+				row:    map[string]interface{}{"name": nil},
+				insert: true,
+				filled: map[string]bool{"id": true},
+			},
+			want: []string{"name"},
+		},
+		{
+			name: "Missing columns on update",
+			args: args{
+				row:    map[string]interface{}{"id": 1.0},
+				insert: false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, field := range ValidateRow(tablecolumns, tt.args.row, tt.args.insert, tt.args.filled, "") {
+				got = append(got, field.Field)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValidateRow() fields = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidationStatusCode(t *testing.T) {
+	err := NewValidationError([]FieldError{{Row: 0, Field: "id", Message: "is required"}})
+	if got := GetStatusCode(nil, err); got != http.StatusUnprocessableEntity {
+		t.Errorf("GetStatusCode() = %v, want %v", got, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestSendProblem(t *testing.T) {
+	defer func() { Responses = config.ResponseInfo{} }()
+
+	tests := []struct {
+		name      string
+		responses config.ResponseInfo
+		accept    string
+		er        error
+		wantType  string
+		wantBody  string
+	}{
+		{
+			name:     "Envelope by default",
+			er:       errors.New("sql: no rows in result set"),
+			wantType: "application/json; charset=UTF-8",
+			wantBody: `"error":{"code":"not_found"}`,
+		},
+		{
+			name:     "Problem accepted",
+			accept:   "application/problem+json, application/json;q=0.5",
+			er:       errors.New("sql: no rows in result set"),
+			wantType: ContentTypeProblem,
+			wantBody: `"type":"about:blank","title":"Not Found","status":404,"detail":"sql: no rows in result set","code":"not_found"`,
+		},
+		{
+			name:      "Problem configured",
+			responses: config.ResponseInfo{Problem: true, ProblemType: "https://example.com/problems/"},
+			er:        apierror.New(http.StatusConflict, apierror.CodeUniqueViolation, "duplicate key").WithTable("crudify"),
+			wantType:  ContentTypeProblem,
+			wantBody:  `"type":"https://example.com/problems/unique_violation","title":"Conflict","status":409`,
+		},
+		{
+			name:      "Bare data",
+			responses: config.ResponseInfo{Bare: true},
+			wantType:  "application/json; charset=UTF-8",
+			wantBody:  `[{"id":1}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Responses = tt.responses
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.Header.Set("Accept", tt.accept)
+			var data interface{}
+			if tt.er == nil {
+				data = []map[string]interface{}{{"id": 1}}
+			}
+			if err := SendAnswer(w, req, data, tt.er); err != nil {
+				t.Errorf("SendAnswer() error = %v", err)
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("SendAnswer() Content-Type = %v, want %v", got, tt.wantType)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("SendAnswer() body = %v, want %v", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
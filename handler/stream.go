@@ -0,0 +1,216 @@
+package handler
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Formats accepted by the stream argument
+const (
+	StreamJSON   = "json"
+	StreamNDJSON = "ndjson"
+	StreamCSV    = "csv"
+)
+
+// Number of rows written between two flushes
+var StreamFlushRows = 100
+
+// Trailer header holding the error of a stream which failed after its status code was sent
+const StreamErrorTrailer = "X-Stream-Error"
+
+// RowStreamer encodes rows to the client as soon as they are read
+// JSON streams are wrapped in the Response envelope unless answers are bare, NDJSON streams write one row per line
+// and CSV streams write a header row of the given columns first
+type RowStreamer struct {
+	w         http.ResponseWriter
+	r         *http.Request
+	format    string
+	columns   []string
+	encoder   *jsoniter.Encoder
+	csvWriter *csv.Writer
+	count     int
+}
+
+// NewRowStreamer sends headers and starts the stream in the given format
+func NewRowStreamer(w http.ResponseWriter, r *http.Request, format string, columns []string) (*RowStreamer, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	switch format {
+	case "", "true", StreamJSON:
+		format = StreamJSON
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	case StreamNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	case StreamCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	default:
+		return nil, apierror.New(http.StatusBadRequest, apierror.CodeInvalidArgument, "Stream format should be "+StreamJSON+", "+StreamNDJSON+" or "+StreamCSV)
+	}
+
+	logger.Log(r).Debug().Msg("Streaming HTTP answer as " + format)
+
+	// Streams last as long as rows are read, the write timeout of the server would cut them
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		logger.Log(r).Warn().Msg("Cannot clear write deadline of stream: " + err.Error())
+	}
+
+	w.Header().Set("Trailer", StreamErrorTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	s := &RowStreamer{w: w, r: r, format: format, columns: columns, encoder: json.NewEncoder(w)}
+	if format == StreamCSV {
+		s.csvWriter = csv.NewWriter(w)
+		if err := s.csvWriter.Write(columns); err != nil {
+			return nil, err
+		}
+	}
+	if format == StreamJSON && Responses.Bare {
+		if _, err := io.WriteString(w, "["); err != nil {
+			return nil, err
+		}
+	} else if format == StreamJSON {
+		myuuid, _ := json.Marshal(GetUUID(r))
+		mytime, _ := json.Marshal(time.Now())
+		_, err := io.WriteString(w, `{"uuid":`+string(myuuid)+`,"time":`+string(mytime)+`,"data":[`)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// WriteRow encodes a single row and flushes regularly
+func (s *RowStreamer) WriteRow(row map[string]interface{}) error {
+	if s.format == StreamCSV {
+		if err := s.csvWriter.Write(csvRecord(s.columns, row)); err != nil {
+			return err
+		}
+	} else {
+		if s.format == StreamJSON && s.count > 0 {
+			if _, err := io.WriteString(s.w, ","); err != nil {
+				return err
+			}
+		}
+		if err := s.encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	s.count++
+	if s.count%StreamFlushRows == 0 {
+		s.Flush()
+	}
+	return nil
+}
+
+// Convert a row into a csv record following columns order, null values are left empty
+func csvRecord(columns []string, row map[string]interface{}) []string {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		switch value := row[column].(type) {
+		case nil:
+		case string:
+			record[i] = value
+		case map[string]interface{}, []interface{}, []map[string]interface{}:
+			nested, _ := json.Marshal(value)
+			record[i] = string(nested)
+		default:
+			record[i] = fmt.Sprintf("%v", value)
+		}
+	}
+	return record
+}
+
+// Flush sends buffered rows to the client
+func (s *RowStreamer) Flush() {
+	if s.csvWriter != nil {
+		s.csvWriter.Flush()
+	}
+	if flusher, ok := s.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close ends the stream, the error of a failed stream is written in its message
+// and in the trailer since the status code was already sent
+func (s *RowStreamer) Close(er error) error {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	var msg string
+	var err error
+
+	if er != nil {
+		msg = er.Error()
+		s.w.Header().Set(StreamErrorTrailer, msg)
+	}
+	switch {
+	case s.format == StreamJSON && Responses.Bare:
+		_, err = io.WriteString(s.w, "]\n")
+	case s.format == StreamJSON:
+		mymsg, _ := json.Marshal(msg)
+		_, err = io.WriteString(s.w, `],"message":`+string(mymsg)+"}\n")
+	case s.format == StreamNDJSON && er != nil:
+		err = s.encoder.Encode(Response{Uuid: GetUUID(s.r), Time: time.Now(), Message: msg})
+	}
+	s.Flush()
+	return err
+}
+
+// Generic get streaming rows as they are read from database
+func StreamGet(w http.ResponseWriter, r *http.Request, tablename string, args map[string]string, format string) {
+	var streamer *RowStreamer
+
+	_, nested := args[dbhelper.REQUEST_ARG_PREFIX+"nested"]
+	err := dbhelper.SelectRows(r, tablename, args, func(rows *sql.Rows) error {
+		columns, err := rows.Columns()
+		if err != nil {
+			return err
+		}
+		streamer, err = NewRowStreamer(w, r, format, columns)
+		if err != nil {
+			return err
+		}
+		return dbhelper.ScanRows(rows, func(row map[string]interface{}) error {
+			// Nested objects are looked up with the actual values of keys, masked afterwards
+			if nested {
+				if _, err := dbhelper.AddNestedObjects(r, &[]map[string]interface{}{row}, tablename); err != nil {
+					return err
+				}
+			}
+			dbhelper.MaskRow(r, tablename, row)
+			return streamer.WriteRow(row)
+		})
+	})
+	if streamer == nil && err == nil {
+		err = SendAnswer(w, r, []map[string]interface{}{}, nil)
+		if err != nil {
+			logger.Log(r).Warn().Msg(err.Error())
+		}
+		return
+	}
+	if streamer == nil {
+		logger.Log(r).Warn().Msg(err.Error())
+		err = SendAnswer(w, r, nil, err)
+		if err != nil {
+			logger.Log(r).Warn().Msg(err.Error())
+		}
+		return
+	}
+	if err != nil {
+		logger.Log(r).Warn().Msg(err.Error())
+	}
+	err = streamer.Close(err)
+	if err != nil {
+		logger.Log(r).Warn().Msg(err.Error())
+	}
+}
@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// FieldError describes why a field of a row is invalid
+type FieldError struct {
+	Row     int    `json:"row"`
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// NewValidationError creates an error listing every invalid field of a body in its details
+func NewValidationError(fields []FieldError) *apierror.Error {
+	var msgs []string
+	for _, field := range fields {
+		msgs = append(msgs, "row "+strconv.Itoa(field.Row)+" "+field.Field+": "+field.Message)
+	}
+	message := "Validation failed: " + strings.Join(msgs, ", ")
+	return apierror.New(http.StatusUnprocessableEntity, apierror.CodeValidationFailed, message).WithDetails(fields)
+}
+
+// ValidateBody checks rows against the schema of their table before any query runs
+// Required columns are only checked on insert, where nested rows of related tables are validated too
+func ValidateBody(r *http.Request, tablename string, rows []map[string]interface{}, insert bool) error {
+	var fields []FieldError
+
+	logger.Log(r).Debug().Msg("Validating body against table: " + tablename)
+
+	for i, row := range rows {
+		errs, err := validateRow(r, tablename, row, insert, map[string]bool{}, "")
+		if err != nil {
+			return err
+		}
+		for _, fieldErr := range errs {
+			fieldErr.Row = i
+			fields = append(fields, fieldErr)
+		}
+	}
+	if len(fields) > 0 {
+		return NewValidationError(fields)
+	}
+	return nil
+}
+
+// Validate a row and its nested rows, filled columns are set by nested inserts
+func validateRow(r *http.Request, tablename string, row map[string]interface{}, insert bool, filled map[string]bool, prefix string) ([]FieldError, error) {
+	tablecolumns, err := dbhelper.GetColumns(r, tablename)
+	if err != nil {
+		return nil, err
+	}
+
+	columns := row
+	var nested map[string][]map[string]interface{}
+	if insert {
+		columns, nested, err = dbhelper.SplitNestedObjects(r, row)
+		if err != nil {
+			return []FieldError{{Field: prefix, Message: err.Error()}}, nil
+		}
+	}
+
+	// Mandatory filters of the policy are set on inserted rows missing them
+	if policy, ok := dbhelper.GetPolicy(r); ok && insert && policy.Table == tablename {
+		for column := range policy.Filters {
+			filled[column] = true
+		}
+	}
+
+	var fields []FieldError
+	for nestedtable, objects := range nested {
+		parentColumns, childColumns, err := relationColumns(r, tablename, nestedtable)
+		if err != nil {
+			return nil, err
+		}
+		if len(parentColumns) <= 0 && len(childColumns) <= 0 {
+			fields = append(fields, FieldError{Field: prefix + nestedtable, Message: "no foreign key between " + tablename + " and " + nestedtable})
+			continue
+		}
+		for _, column := range parentColumns {
+			filled[column] = true
+		}
+		childFilled := map[string]bool{}
+		for _, column := range childColumns {
+			childFilled[column] = true
+		}
+		nestedRequest, err := dbhelper.NestedRequest(r, nestedtable, http.MethodPost)
+		if err != nil {
+			return nil, err
+		}
+		for i, object := range objects {
+			errs, err := validateRow(nestedRequest, nestedtable, object, insert, childFilled, prefix+nestedtable+"["+strconv.Itoa(i)+"].")
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, errs...)
+		}
+	}
+
+	fields = append(fields, ValidateRow(tablecolumns, columns, insert, filled, prefix)...)
+	return fields, nil
+}
+
+// Columns of a table referencing a nested table, and columns of the nested table referencing the table
+func relationColumns(r *http.Request, tablename string, nestedtable string) ([]string, []string, error) {
+	var parentColumns, childColumns []string
+
+	foreignKeys, err := dbhelper.SelectForeignKeys(r, tablename)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, foreignKeyMap := range *foreignKeys {
+		if fmt.Sprintf("%v", foreignKeyMap["foreign_table_name"]) == nestedtable {
+			parentColumns = append(parentColumns, fmt.Sprintf("%v", foreignKeyMap["column_name"]))
+		}
+	}
+	referencingKeys, err := dbhelper.SelectReferencingKeys(r, tablename)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, referencingKeyMap := range *referencingKeys {
+		if fmt.Sprintf("%v", referencingKeyMap["table_name"]) == nestedtable {
+			childColumns = append(childColumns, fmt.Sprintf("%v", referencingKeyMap["column_name"]))
+		}
+	}
+	return parentColumns, childColumns, nil
+}
+
+// ValidateRow checks values of a row against table columns
+func ValidateRow(tablecolumns map[string]dbhelper.Column, row map[string]interface{}, insert bool, filled map[string]bool, prefix string) []FieldError {
+	var fields []FieldError
+
+	for key, value := range row {
+		column, ok := tablecolumns[key]
+		if !ok {
+			fields = append(fields, FieldError{Field: prefix + key, Message: "unknown column"})
+			continue
+		}
+		if msg := validateValue(column, value); msg != "" {
+			fields = append(fields, FieldError{Field: prefix + key, Message: msg})
+		}
+	}
+	if insert {
+		for name, column := range tablecolumns {
+			if _, ok := row[name]; !ok && !column.Nullable && !column.HasDefault && !filled[name] {
+				fields = append(fields, FieldError{Field: prefix + name, Message: "is required"})
+			}
+		}
+	}
+	return fields
+}
+
+// Smallest and largest values of integer types
+var integerBounds = map[string][2]int64{
+	"smallint": {math.MinInt16, math.MaxInt16},
+	"integer":  {math.MinInt32, math.MaxInt32},
+	"bigint":   {math.MinInt64, math.MaxInt64},
+}
+
+// Check a single value against its column, returns why it is invalid
+func validateValue(column dbhelper.Column, value interface{}) string {
+	if value == nil {
+		if !column.Nullable {
+			return "must not be null"
+		}
+		return ""
+	}
+
+	switch column.Type {
+	case "smallint", "integer", "bigint":
+		bounds := integerBounds[column.Type]
+		switch val := value.(type) {
+		case float64:
+			if val != math.Trunc(val) {
+				return "must be an integer"
+			}
+			// The upper bound of bigint is not exact as a float, values from 2^63 are out of range
+			if val < float64(bounds[0]) || val >= float64(bounds[1])+1 {
+				return "must be between " + strconv.FormatInt(bounds[0], 10) + " and " + strconv.FormatInt(bounds[1], 10)
+			}
+		case string:
+			number, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+			if err != nil && errors.Is(err, strconv.ErrRange) || err == nil && (number < bounds[0] || number > bounds[1]) {
+				return "must be between " + strconv.FormatInt(bounds[0], 10) + " and " + strconv.FormatInt(bounds[1], 10)
+			}
+			if err != nil {
+				return "must be an integer"
+			}
+		default:
+			return "must be an integer"
+		}
+	case "money":
+		// Strings are left to the database, which parses them with the currency format of its locale
+		switch value.(type) {
+		case float64, string:
+		default:
+			return "must be a number"
+		}
+	case "numeric", "decimal", "real", "double precision":
+		switch val := value.(type) {
+		case float64:
+		case string:
+			if _, err := strconv.ParseFloat(strings.TrimSpace(val), 64); err != nil {
+				return "must be a number"
+			}
+		default:
+			return "must be a number"
+		}
+	case "boolean":
+		switch val := value.(type) {
+		case bool:
+		case string:
+			if _, err := strconv.ParseBool(val); err != nil {
+				return "must be a boolean"
+			}
+		default:
+			return "must be a boolean"
+		}
+	case "json", "jsonb":
+	case "ARRAY":
+		switch value.(type) {
+		case []interface{}, string:
+		default:
+			return "must be an array"
+		}
+	default:
+		val, ok := value.(string)
+		if !ok {
+			return "must be a string"
+		}
+		if column.MaxLength > 0 && utf8.RuneCountInString(val) > column.MaxLength {
+			return "must be at most " + strconv.Itoa(column.MaxLength) + " characters long"
+		}
+		if len(column.Enum) > 0 {
+			for _, label := range column.Enum {
+				if label == val {
+					return ""
+				}
+			}
+			return "must be one of " + strings.Join(column.Enum, ", ")
+		}
+	}
+	return ""
+}
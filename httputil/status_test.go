@@ -0,0 +1,41 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(w http.ResponseWriter)
+		want    int
+	}{
+		{"nothing sent", func(w http.ResponseWriter) {}, http.StatusOK},
+		{"header", func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) }, http.StatusNotFound},
+		{"first header", func(w http.ResponseWriter) {
+			w.WriteHeader(http.StatusCreated)
+			w.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusCreated},
+		{"body", func(w http.ResponseWriter) { w.Write([]byte("ok")) }, http.StatusOK},
+		{"flush", func(w http.ResponseWriter) { w.(http.Flusher).Flush() }, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := NewStatusRecorder(httptest.NewRecorder())
+			tt.handler(recorder)
+			if got := recorder.Status(); got != tt.want {
+				t.Errorf("Status() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, _, err := NewStatusRecorder(httptest.NewRecorder()).Hijack(); err == nil {
+		t.Error("Hijack() of a response writer without connection did not fail")
+	}
+	w := httptest.NewRecorder()
+	if err := http.NewResponseController(NewStatusRecorder(w)).Flush(); err != nil || !w.Flushed {
+		t.Errorf("ResponseController did not flush the wrapped writer: %v", err)
+	}
+}
@@ -28,16 +28,25 @@ func Log(r *http.Request) *zerolog.Logger {
 }
 
 // LogWithContext takes a context in argument and returns a logger
-// We try to search in context if a "uuid" is stored, if found we add it
+// We try to search in context if a "uuid" or a "traceid" is stored, if found we add them
 func LogWithContext(c context.Context) *zerolog.Logger {
 	if c == nil {
 		return &log.Logger
 	}
-	if uuid := c.Value("uuid"); uuid != nil {
-		mylogger := log.With().Str("UUID", uuid.(string)).Logger()
-		return &mylogger
+	uuid, hasUUID := c.Value("uuid").(string)
+	traceID, hasTraceID := c.Value("traceid").(string)
+	if !hasUUID && !hasTraceID {
+		return &log.Logger
+	}
+	mycontext := log.With()
+	if hasUUID {
+		mycontext = mycontext.Str("UUID", uuid)
+	}
+	if hasTraceID {
+		mycontext = mycontext.Str("trace_id", traceID)
 	}
-	return &log.Logger
+	mylogger := mycontext.Logger()
+	return &mylogger
 }
 
 // LoggerWithFlags returns a logger with flags
@@ -1,9 +1,15 @@
 package logger
 
 import (
+	"bytes"
+	"context"
 	"net/http"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
 type TestRoute struct {
@@ -53,3 +59,32 @@ func TestLogger(t *testing.T) {
 		})
 	}
 }
+
+func TestLogWithContext(t *testing.T) {
+	var buffer bytes.Buffer
+	defaultLogger := log.Logger
+	log.Logger = zerolog.New(&buffer)
+	defer func() { log.Logger = defaultLogger }()
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want []string
+	}{
+		{"without context", nil, []string{`"message":"test"`}},
+		{"uuid", context.WithValue(context.Background(), "uuid", "42"), []string{`"UUID":"42"`}},
+		{"uuid and trace id", context.WithValue(context.WithValue(context.Background(), "uuid", "42"), "traceid", "4bf92f3577b34da6a3ce929d0e0e4736"),
+			[]string{`"UUID":"42"`, `"trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer.Reset()
+			LogWithContext(tt.ctx).Info().Msg("test")
+			for _, field := range tt.want {
+				if !strings.Contains(buffer.String(), field) {
+					t.Errorf("LogWithContext() wrote %v, want %v", buffer.String(), field)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/maxime1907/crudify/httputil"
+)
+
+// Instrument counts requests of a route and observes their duration by status
+func Instrument(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := httputil.NewStatusRecorder(w)
+
+		inner.ServeHTTP(recorder, r)
+
+		status := recorder.Status()
+		Requests.Inc(name, r.Method, strconv.Itoa(status))
+		RequestDuration.Observe(time.Since(start).Seconds(), name, r.Method, strconv.Itoa(status))
+	})
+}
@@ -0,0 +1,270 @@
+package metrics
+
+import (
+	"bytes"
+	"database/sql"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Content type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Buckets of durations in seconds, from 5ms to 10s
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Collector writes its metrics in the text exposition format
+type Collector interface {
+	Write(buffer *bytes.Buffer)
+}
+
+// Metrics of crudify, written along with those registered
+var (
+	Requests        = NewCounter("crudify_http_requests_total", "Number of HTTP requests by route and status.", "route", "method", "status")
+	RequestDuration = NewHistogram("crudify_http_request_duration_seconds", "Duration of HTTP requests by route and status.", DefaultBuckets, "route", "method", "status")
+	Panics          = NewCounter("crudify_panics_total", "Number of panics recovered in handlers by route.", "route")
+	QueryDuration   = NewHistogram("crudify_db_query_duration_seconds", "Duration of generic queries by table and operation.", DefaultBuckets, "table", "operation")
+	SchemaReloads   = NewCounter("crudify_schema_reloads_total", "Number of times the schema was read from the database by kind.", "kind")
+	Pool            = &DBCollector{}
+)
+
+var collectorsMutex sync.RWMutex
+var collectors = []Collector{Requests, RequestDuration, Panics, QueryDuration, SchemaReloads, Pool}
+
+// Register adds collectors written by MetricsGet
+func Register(newCollectors ...Collector) {
+	collectorsMutex.Lock()
+	defer collectorsMutex.Unlock()
+	collectors = append(collectors, newCollectors...)
+}
+
+// Escape a label value
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Format labels as {name="value",...}, empty without labels
+func formatLabels(names []string, values []string) string {
+	if len(names) <= 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names))
+	for i, name := range names {
+		pairs = append(pairs, name+`="`+escape(values[i])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeHeader(buffer *bytes.Buffer, name string, help string, kind string) {
+	buffer.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " " + kind + "\n")
+}
+
+// Values of labels, missing ones are empty and extra ones ignored
+func labelValues(names []string, values []string) []string {
+	myvalues := make([]string, len(names))
+	copy(myvalues, values)
+	return myvalues
+}
+
+// Sorted keys of series, so that metrics are written in a stable order
+func sortedKeys(series map[string][]string) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Counter counts events by label values
+type Counter struct {
+	name   string
+	help   string
+	labels []string
+	mutex  sync.Mutex
+	series map[string][]string
+	values map[string]float64
+}
+
+// NewCounter creates a counter, written once registered
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{name: name, help: help, labels: labels, series: map[string][]string{}, values: map[string]float64{}}
+}
+
+// Add adds a value to the counter of label values
+func (c *Counter) Add(value float64, labels ...string) {
+	values := labelValues(c.labels, labels)
+	key := strings.Join(values, "\xff")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.series[key] = values
+	c.values[key] += value
+}
+
+// Inc increments the counter of label values
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+// Value returns the counter of label values
+func (c *Counter) Value(labels ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[strings.Join(labelValues(c.labels, labels), "\xff")]
+}
+
+// Write writes the counter of every label values
+func (c *Counter) Write(buffer *bytes.Buffer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	writeHeader(buffer, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.series) {
+		buffer.WriteString(c.name + formatLabels(c.labels, c.series[key]) + " " + formatFloat(c.values[key]) + "\n")
+	}
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations in cumulative buckets by label values
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string][]string
+	values  map[string]*histogramValue
+}
+
+// NewHistogram creates a histogram with the upper bounds of its buckets, written once registered
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	mybuckets := append([]float64{}, buckets...)
+	sort.Float64s(mybuckets)
+	return &Histogram{name: name, help: help, labels: labels, buckets: mybuckets, series: map[string][]string{}, values: map[string]*histogramValue{}}
+}
+
+// Observe adds a value to the histogram of label values
+func (h *Histogram) Observe(value float64, labels ...string) {
+	values := labelValues(h.labels, labels)
+	key := strings.Join(values, "\xff")
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	myvalue, ok := h.values[key]
+	if !ok {
+		myvalue = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = values
+		h.values[key] = myvalue
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			myvalue.counts[i]++
+		}
+	}
+	myvalue.count++
+	myvalue.sum += value
+}
+
+// Count returns the number of observations of label values
+func (h *Histogram) Count(labels ...string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if myvalue, ok := h.values[strings.Join(labelValues(h.labels, labels), "\xff")]; ok {
+		return myvalue.count
+	}
+	return 0
+}
+
+// Write writes the buckets, sum and count of every label values
+func (h *Histogram) Write(buffer *bytes.Buffer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	writeHeader(buffer, h.name, h.help, "histogram")
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.series) {
+		values, myvalue := h.series[key], h.values[key]
+		for i, bound := range h.buckets {
+			buffer.WriteString(h.name + "_bucket" + formatLabels(bucketLabels, append(append([]string{}, values...), formatFloat(bound))) +
+				" " + strconv.FormatUint(myvalue.counts[i], 10) + "\n")
+		}
+		buffer.WriteString(h.name + "_bucket" + formatLabels(bucketLabels, append(append([]string{}, values...), "+Inf")) +
+			" " + strconv.FormatUint(myvalue.count, 10) + "\n")
+		buffer.WriteString(h.name + "_sum" + formatLabels(h.labels, values) + " " + formatFloat(myvalue.sum) + "\n")
+		buffer.WriteString(h.name + "_count" + formatLabels(h.labels, values) + " " + strconv.FormatUint(myvalue.count, 10) + "\n")
+	}
+}
+
+// DBCollector writes statistics of a connection pool, read when metrics are written
+type DBCollector struct {
+	mutex sync.RWMutex
+	db    *sql.DB
+}
+
+// Set the pool to collect, none when nil
+func (c *DBCollector) Set(db *sql.DB) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.db = db
+}
+
+// Write writes gauges of connections and counters of waits for a connection
+func (c *DBCollector) Write(buffer *bytes.Buffer) {
+	c.mutex.RLock()
+	db := c.db
+	c.mutex.RUnlock()
+	if db == nil {
+		return
+	}
+	stats := db.Stats()
+
+	gauges := []struct {
+		name  string
+		help  string
+		value int
+	}{
+		{"crudify_db_max_open_connections", "Maximum number of open connections to the database.", stats.MaxOpenConnections},
+		{"crudify_db_open_connections", "Number of open connections to the database.", stats.OpenConnections},
+		{"crudify_db_in_use_connections", "Number of connections in use.", stats.InUse},
+		{"crudify_db_idle_connections", "Number of idle connections.", stats.Idle},
+	}
+	for _, gauge := range gauges {
+		writeHeader(buffer, gauge.name, gauge.help, "gauge")
+		buffer.WriteString(gauge.name + " " + strconv.Itoa(gauge.value) + "\n")
+	}
+	writeHeader(buffer, "crudify_db_wait_count_total", "Number of connections waited for.", "counter")
+	buffer.WriteString("crudify_db_wait_count_total " + strconv.FormatInt(stats.WaitCount, 10) + "\n")
+	writeHeader(buffer, "crudify_db_wait_duration_seconds_total", "Time spent waiting for a connection.", "counter")
+	buffer.WriteString("crudify_db_wait_duration_seconds_total " + formatFloat(stats.WaitDuration.Seconds()) + "\n")
+}
+
+// MetricsGet answers registered metrics in the Prometheus text exposition format
+func MetricsGet(w http.ResponseWriter, r *http.Request) {
+	var buffer bytes.Buffer
+
+	collectorsMutex.RLock()
+	for _, collector := range collectors {
+		collector.Write(&buffer)
+	}
+	collectorsMutex.RUnlock()
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(buffer.Bytes())
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	counter := NewCounter("test_total", "Test counter.", "route", "status")
+	counter.Inc("get_orders", "200")
+	counter.Inc("get_orders", "200")
+	counter.Add(3, `say "hi"`, "500")
+
+	var buffer bytes.Buffer
+	counter.Write(&buffer)
+	want := "# HELP test_total Test counter.\n# TYPE test_total counter\n" +
+		"test_total{route=\"get_orders\",status=\"200\"} 2\n" +
+		"test_total{route=\"say \\\"hi\\\"\",status=\"500\"} 3\n"
+	if buffer.String() != want {
+		t.Errorf("Counter.Write() = %v, want %v", buffer.String(), want)
+	}
+	if counter.Value("get_orders", "200") != 2 {
+		t.Errorf("Counter.Value() = %v, want 2", counter.Value("get_orders", "200"))
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	histogram := NewHistogram("test_seconds", "Test histogram.", []float64{1, 0.1}, "table")
+	histogram.Observe(0.05, "orders")
+	histogram.Observe(0.5, "orders")
+	histogram.Observe(2, "orders")
+
+	var buffer bytes.Buffer
+	histogram.Write(&buffer)
+	for _, line := range []string{
+		`test_seconds_bucket{table="orders",le="0.1"} 1`,
+		`test_seconds_bucket{table="orders",le="1"} 2`,
+		`test_seconds_bucket{table="orders",le="+Inf"} 3`,
+		`test_seconds_sum{table="orders"} 2.55`,
+		`test_seconds_count{table="orders"} 3`,
+	} {
+		if !strings.Contains(buffer.String(), line+"\n") {
+			t.Errorf("Histogram.Write() misses %v in %v", line, buffer.String())
+		}
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		status  string
+	}{
+		{"implicit", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok")) }, "200"},
+		{"explicit", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNotFound) }, "404"},
+		{"flushed", func(w http.ResponseWriter, r *http.Request) { http.NewResponseController(w).Flush() }, "200"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Instrument(tt.handler, "test_"+tt.name).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			if got := Requests.Value("test_"+tt.name, "GET", tt.status); got != 1 {
+				t.Errorf("Instrument() counted %v requests with status %v, want 1", got, tt.status)
+			}
+			if got := RequestDuration.Count("test_"+tt.name, "GET", tt.status); got != 1 {
+				t.Errorf("Instrument() observed %v durations with status %v, want 1", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestMetricsGet(t *testing.T) {
+	Panics.Inc("test_panic")
+
+	w := httptest.NewRecorder()
+	MetricsGet(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Header().Get("Content-Type") != ContentType {
+		t.Errorf("MetricsGet() content type = %v", w.Header().Get("Content-Type"))
+	}
+	for _, line := range []string{"# TYPE crudify_http_requests_total counter", `crudify_panics_total{route="test_panic"} 1`} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("MetricsGet() misses %v", line)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxime1907/crudify/config"
+)
+
+// Security of SMTP connections
+const (
+	// Upgrade with STARTTLS when the server offers it (default)
+	SecurityOpportunistic = ""
+	// Require STARTTLS
+	SecurityStartTLS = "starttls"
+	// Connect over TLS, usually on port 465
+	SecurityTLS = "tls"
+	// Never use TLS
+	SecurityNone = "none"
+)
+
+// Timeout of SMTP connections
+var DialTimeout = 30 * time.Second
+
+// Timeout of the whole SMTP exchange of a message, from the greeting of the server to QUIT
+var SendTimeout = 2 * time.Minute
+
+// Message is an email with a text body, an HTML body or both
+type Message struct {
+	To      []string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Write a body part encoded as quoted-printable
+func writePart(writer *multipart.Writer, contentType string, body string) error {
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err = qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// Build returns a message as MIME, with encoded headers and a multipart/alternative body when it has both bodies
+func Build(from string, message Message) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	sender := mail.Address{Address: from}
+	var recipients []string
+	for _, to := range message.To {
+		address, err := mail.ParseAddress(to)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, address.String())
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	fmt.Fprintf(&buffer, "From: %s\r\n", sender.String())
+	fmt.Fprintf(&buffer, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&buffer, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", message.Subject))
+	fmt.Fprintf(&buffer, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buffer, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	fmt.Fprintf(&buffer, "MIME-Version: 1.0\r\n")
+
+	if message.Text == "" || message.HTML == "" {
+		contentType, body := "text/plain", message.Text
+		if message.HTML != "" {
+			contentType, body = "text/html", message.HTML
+		}
+		fmt.Fprintf(&buffer, "Content-Type: %s; charset=UTF-8\r\n", contentType)
+		fmt.Fprintf(&buffer, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		qp := quotedprintable.NewWriter(&buffer)
+		if _, err := qp.Write([]byte(body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	fmt.Fprintf(&buffer, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", writer.Boundary())
+	if err := writePart(writer, "text/plain", message.Text); err != nil {
+		return nil, err
+	}
+	if err := writePart(writer, "text/html", message.HTML); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	buffer.Write(body.Bytes())
+	return buffer.Bytes(), nil
+}
+
+// Connect to the SMTP server with the configured security
+func dial(smtpinfo config.SMTPInfo) (*smtp.Client, error) {
+	addr := net.JoinHostPort(smtpinfo.Host, strconv.Itoa(smtpinfo.Port))
+	tlsconfig := &tls.Config{ServerName: smtpinfo.Host}
+
+	if smtpinfo.Security == SecurityTLS {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: DialTimeout}, "tcp", addr, tlsconfig)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(SendTimeout))
+		c, err := smtp.NewClient(conn, smtpinfo.Host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", addr, DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// A server that stops answering would block the queue, STARTTLS keeps the deadline of the connection
+	conn.SetDeadline(time.Now().Add(SendTimeout))
+	c, err := smtp.NewClient(conn, smtpinfo.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	switch smtpinfo.Security {
+	case SecurityNone:
+		return c, nil
+	case SecurityStartTLS, SecurityOpportunistic:
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			if smtpinfo.Security == SecurityStartTLS {
+				c.Close()
+				return nil, errors.New("SMTP server " + addr + " does not support STARTTLS")
+			}
+			return c, nil
+		}
+		if err = c.StartTLS(tlsconfig); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+	c.Close()
+	return nil, errors.New("Unknown SMTP security " + smtpinfo.Security)
+}
+
+// Send delivers a message through the configured SMTP server, from its owner email
+func Send(smtpinfo config.SMTPInfo, message Message) error {
+	content, err := Build(smtpinfo.OwnerEmail, message)
+	if err != nil {
+		return err
+	}
+
+	c, err := dial(smtpinfo)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if smtpinfo.Password != "" {
+		username := smtpinfo.Username
+		if username == "" {
+			username = smtpinfo.OwnerEmail
+		}
+		if err = c.Auth(smtp.PlainAuth("", username, smtpinfo.Password, smtpinfo.Host)); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(smtpinfo.OwnerEmail); err != nil {
+		return err
+	}
+	for _, to := range message.To {
+		address, err := mail.ParseAddress(to)
+		if err != nil {
+			return err
+		}
+		if err = c.Rcpt(address.Address); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(content); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
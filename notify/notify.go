@@ -0,0 +1,180 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	htmltemplate "html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Attempts to send a message when none are configured
+const DefaultRetries = 3
+
+// Delay before the first retry, doubled after every failed attempt
+var RetryDelay = 10 * time.Second
+
+// Messages waiting to be sent, others are dropped
+const queueSize = 1000
+
+type queued struct {
+	message  Message
+	attempts int
+}
+
+// Queue sends messages in the background, retrying failed ones
+type Queue struct {
+	smtpinfo config.SMTPInfo
+	messages chan queued
+	pending  sync.WaitGroup
+}
+
+// NewQueue creates a queue sending messages through an SMTP server, started by Run
+func NewQueue(smtpinfo config.SMTPInfo) *Queue {
+	return &Queue{smtpinfo: smtpinfo, messages: make(chan queued, queueSize)}
+}
+
+// Push queues a message, it is dropped when the queue is full
+func (q *Queue) Push(message Message) {
+	q.push(queued{message: message})
+}
+
+func (q *Queue) push(item queued) {
+	select {
+	case q.messages <- item:
+	default:
+		logger.Log(nil).Error().Msg("Email queue is full, dropping message " + item.message.Subject)
+	}
+}
+
+// Run sends queued messages until ctx is done
+func (q *Queue) Run(ctx context.Context) {
+	retries := q.smtpinfo.Retries
+	if retries <= 0 {
+		retries = DefaultRetries
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			q.pending.Wait()
+			if len(q.messages) > 0 {
+				logger.Log(nil).Warn().Msg(strconv.Itoa(len(q.messages)) + " emails were not sent before shutdown")
+			}
+			return
+		case item := <-q.messages:
+			err := Send(q.smtpinfo, item.message)
+			if err == nil {
+				continue
+			}
+			item.attempts++
+			if item.attempts >= retries {
+				logger.Log(nil).Error().Msg("Cannot send email " + item.message.Subject + ": " + err.Error())
+				continue
+			}
+			logger.Log(nil).Warn().Msg("Cannot send email " + item.message.Subject + ", retrying: " + err.Error())
+			q.retry(ctx, item)
+		}
+	}
+}
+
+// Queue a message again after a delay growing with its attempts
+func (q *Queue) retry(ctx context.Context, item queued) {
+	delay := RetryDelay * time.Duration(1<<uint(item.attempts-1))
+
+	q.pending.Add(1)
+	go func() {
+		defer q.pending.Done()
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+			q.push(item)
+		}
+	}()
+}
+
+// Templates of a notification
+type rule struct {
+	info    config.NotificationInfo
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+// Notifier renders the notifications matching events and queues them
+type Notifier struct {
+	rules []rule
+	queue *Queue
+}
+
+// NewNotifier parses the templates of notifications
+// Templates are executed with the event: .Table, .Operation, .Rows, .UUID and .Time
+func NewNotifier(notifications []config.NotificationInfo, queue *Queue) (*Notifier, error) {
+	notifier := &Notifier{queue: queue}
+
+	for _, info := range notifications {
+		var err error
+		myrule := rule{info: info}
+
+		myrule.subject, err = template.New("subject").Parse(info.Subject)
+		if err != nil {
+			return nil, err
+		}
+		if info.Text != "" {
+			myrule.text, err = template.New("text").Parse(info.Text)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if info.HTML != "" {
+			myrule.html, err = htmltemplate.New("html").Parse(info.HTML)
+			if err != nil {
+				return nil, err
+			}
+		}
+		notifier.rules = append(notifier.rules, myrule)
+	}
+	return notifier, nil
+}
+
+// Render the message of a rule for an event
+func (myrule rule) render(event dbhelper.Event) (Message, error) {
+	var subject, text, html bytes.Buffer
+
+	if err := myrule.subject.Execute(&subject, event); err != nil {
+		return Message{}, err
+	}
+	if myrule.text != nil {
+		if err := myrule.text.Execute(&text, event); err != nil {
+			return Message{}, err
+		}
+	}
+	if myrule.html != nil {
+		if err := myrule.html.Execute(&html, event); err != nil {
+			return Message{}, err
+		}
+	}
+	return Message{To: myrule.info.To, Subject: subject.String(), Text: text.String(), HTML: html.String()}, nil
+}
+
+// Notify queues a message for every notification matching an event, it is a dbhelper.Listener
+func (n *Notifier) Notify(r *http.Request, event dbhelper.Event) {
+	for _, myrule := range n.rules {
+		if myrule.info.Table != event.Table || !dbhelper.MatchOperation(myrule.info.Operations, event.Operation) {
+			continue
+		}
+		message, err := myrule.render(event)
+		if err != nil {
+			logger.Log(r).Error().Msg("Cannot render notification on " + event.Table + ": " + err.Error())
+			continue
+		}
+		n.queue.Push(message)
+	}
+}
@@ -0,0 +1,232 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
+)
+
+// Fake SMTP server keeping received messages, failing the first failures transactions
+type fakeSMTP struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	messages []string
+	failures int
+	received chan bool
+}
+
+func newFakeSMTP(t *testing.T, failures int) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSMTP{listener: l, failures: failures, received: make(chan bool, 10)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return server
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost fake SMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL"), strings.HasPrefix(command, "RCPT"):
+			s.mutex.Lock()
+			failing := s.failures > 0
+			s.mutex.Unlock()
+			if failing && strings.HasPrefix(command, "MAIL") {
+				s.mutex.Lock()
+				s.failures--
+				s.mutex.Unlock()
+				reply("451 try again later")
+				continue
+			}
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 end with .")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			s.mutex.Lock()
+			s.messages = append(s.messages, data.String())
+			s.mutex.Unlock()
+			s.received <- true
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func (s *fakeSMTP) info() config.SMTPInfo {
+	_, port, _ := net.SplitHostPort(s.listener.Addr().String())
+	myport, _ := strconv.Atoi(port)
+	return config.SMTPInfo{OwnerEmail: "crudify@example.com", Host: "127.0.0.1", Port: myport, Security: SecurityNone}
+}
+
+func TestBuild(t *testing.T) {
+	content, err := Build("crudify@example.com", Message{
+		To:      []string{"Alice <alice@example.com>"},
+		Subject: "Commande reçue",
+		Text:    "Merci pour votre commande",
+		HTML:    "<p>Merci pour votre commande</p>",
+	})
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(string(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Commande reçue" {
+		t.Errorf("Build() subject = %v %v", subject, err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Build() content type = %v %v", mediaType, err)
+	}
+
+	var types []string
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := ioutil.ReadAll(part)
+		types = append(types, part.Header.Get("Content-Type"))
+		if !strings.Contains(string(body), "Merci pour votre commande") {
+			t.Errorf("Build() part %v = %s", part.Header.Get("Content-Type"), body)
+		}
+	}
+	if len(types) != 2 {
+		t.Errorf("Build() parts = %v, want text and HTML", types)
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	server := newFakeSMTP(t, 1)
+	RetryDelay = 10 * time.Millisecond
+
+	queue := NewQueue(server.info())
+	notifier, err := NewNotifier([]config.NotificationInfo{
+		{
+			Table:      "orders",
+			Operations: []string{"insert"},
+			To:         []string{"sales@example.com"},
+			Subject:    "{{len .Rows}} new order(s)",
+			Text:       "{{range .Rows}}Order {{.id}} by {{.customer}}\n{{end}}",
+			HTML:       "{{range .Rows}}<p>Order {{.id}} by {{.customer}}</p>{{end}}",
+		},
+	}, queue)
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Run(ctx)
+
+	notifier.Notify(nil, dbhelper.Event{Table: "orders", Operation: dbhelper.OperationDelete, Rows: []map[string]interface{}{{"id": 1}}})
+	notifier.Notify(nil, dbhelper.Event{Table: "orders", Operation: dbhelper.OperationInsert, Rows: []map[string]interface{}{
+		{"id": 2, "customer": "<Alice>"},
+	}})
+
+	select {
+	case <-server.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify() sent no email after a retry")
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if len(server.messages) != 1 {
+		t.Fatalf("Notify() sent %v emails, want 1", len(server.messages))
+	}
+	message := server.messages[0]
+	if !strings.Contains(message, "Subject: 1 new order(s)") {
+		t.Errorf("Notify() subject not rendered in %v", message)
+	}
+	if !strings.Contains(message, "Order 2 by <Alice>") || !strings.Contains(message, "&lt;Alice&gt;") {
+		t.Errorf("Notify() bodies not rendered and escaped in %v", message)
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	// A server accepting connections without ever greeting
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	defer func(timeout time.Duration) { SendTimeout = timeout }(SendTimeout)
+	SendTimeout = 100 * time.Millisecond
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	myport, _ := strconv.Atoi(port)
+	done := make(chan error, 1)
+	go func() {
+		done <- Send(config.SMTPInfo{OwnerEmail: "crudify@example.com", Host: "127.0.0.1", Port: myport, Security: SecurityNone}, Message{To: []string{"a@example.com"}, Text: "text"})
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Send() to a silent server error = nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send() to a silent server did not time out")
+	}
+}
@@ -0,0 +1,181 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/auth"
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/handler"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Limits shared by every client, by each client on its own, or by each IP address before authentication
+const (
+	PerGlobal   = "global"
+	PerIdentity = "identity"
+	PerIP       = "ip"
+)
+
+// DefaultStore keeps the buckets of every limited route, replace it before serving to share them between instances
+var DefaultStore Store = NewMemoryStore()
+
+// Enabled tells if rate limits are configured
+func Enabled(limits []config.RateLimitInfo) bool {
+	return len(limits) > 0
+}
+
+// RouteLimits returns the limits applying to a route, those without route apply to every route
+func RouteLimits(limits []config.RateLimitInfo, name string) []config.RateLimitInfo {
+	var routeLimits []config.RateLimitInfo
+
+	for _, limit := range limits {
+		if limit.Rate <= 0 || limit.Burst <= 0 {
+			continue
+		}
+		if limit.Route == "" || limit.Route == name {
+			routeLimits = append(routeLimits, limit)
+		}
+	}
+	return routeLimits
+}
+
+// Split limits counted before authentication, per IP, from the others
+func splitLimits(limits []config.RateLimitInfo) ([]config.RateLimitInfo, []config.RateLimitInfo) {
+	var ipLimits, otherLimits []config.RateLimitInfo
+
+	for _, limit := range limits {
+		if limit.Per == PerIP {
+			ipLimits = append(ipLimits, limit)
+		} else {
+			otherLimits = append(otherLimits, limit)
+		}
+	}
+	return ipLimits, otherLimits
+}
+
+// GetIP returns the IP address a request was sent from
+func GetIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// GetIdentity returns who sent a request: its API key, basic auth user, token subject or else its IP
+func GetIdentity(r *http.Request) string {
+	if id := auth.GetAPIKeyID(r); id != "" {
+		return "apikey:" + id
+	}
+	if username := auth.GetUsername(r); username != "" {
+		return "user:" + username
+	}
+	if sub, ok := auth.GetClaims(r)["sub"]; ok {
+		return "sub:" + fmt.Sprintf("%v", sub)
+	}
+	return GetIP(r)
+}
+
+// Key of the bucket used by a limit, limits without route share their bucket across routes
+func bucketKey(limit config.RateLimitInfo, r *http.Request) string {
+	key := fmt.Sprintf("%s|%s|%v|%d", limit.Route, limit.Per, limit.Rate, limit.Burst)
+	switch limit.Per {
+	case PerGlobal:
+	case PerIP:
+		key += "|" + GetIP(r)
+	default:
+		key += "|" + GetIdentity(r)
+	}
+	return key
+}
+
+// Whole seconds, rounded up so that clients do not retry too early
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Describe the most restrictive limit with RateLimit-* headers
+func setHeaders(w http.ResponseWriter, limit config.RateLimitInfo, result Result) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", ceilSeconds(result.Reset))
+}
+
+// Answer a request over its limit with the seconds to wait before retrying
+func sendLimitError(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	var err error = apierror.New(http.StatusTooManyRequests, apierror.CodeTooManyRequests, "Too many requests, retry in "+ceilSeconds(retryAfter)+" seconds")
+
+	logger.Log(r).Warn().Str("identity", GetIdentity(r)).Msg(err.Error())
+	w.Header().Set("Retry-After", ceilSeconds(retryAfter))
+	err = handler.SendAnswer(w, r, nil, err)
+	if err != nil {
+		logger.Log(r).Warn().Msg(err.Error())
+	}
+}
+
+// Limit answers 429 Too Many Requests when a token bucket of the route is empty, limits per IP are left to LimitIP
+// Every limit of the route takes a token, errors of the store let requests through
+func Limit(inner http.Handler, name string, limits []config.RateLimitInfo) http.Handler {
+	_, routeLimits := splitLimits(RouteLimits(limits, name))
+	return limitHandler(inner, routeLimits)
+}
+
+// LimitIP answers 429 Too Many Requests when a token bucket per IP of the route is empty
+// It runs before authentication, so that clients guessing credentials are limited too
+func LimitIP(inner http.Handler, name string, limits []config.RateLimitInfo) http.Handler {
+	routeLimits, _ := splitLimits(RouteLimits(limits, name))
+	return limitHandler(inner, routeLimits)
+}
+
+// Check every bucket before taking tokens, so that a request refused by a limit does not use the others
+func limitHandler(inner http.Handler, routeLimits []config.RateLimitInfo) http.Handler {
+	if len(routeLimits) <= 0 {
+		return inner
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+
+		strictest, strictestLimit := limitResults(r, routeLimits, now, DefaultStore.Peek)
+		if strictest != nil && strictest.Allowed {
+			strictest, strictestLimit = limitResults(r, routeLimits, now, DefaultStore.Take)
+		}
+		if strictest == nil {
+			inner.ServeHTTP(w, r)
+			return
+		}
+
+		setHeaders(w, strictestLimit, *strictest)
+		if !strictest.Allowed {
+			sendLimitError(w, r, strictest.RetryAfter)
+			return
+		}
+		inner.ServeHTTP(w, r)
+	})
+}
+
+// Apply a store operation to the bucket of every limit and return the most restrictive result
+func limitResults(r *http.Request, routeLimits []config.RateLimitInfo, now time.Time, operation func(string, float64, int, time.Time) (Result, error)) (*Result, config.RateLimitInfo) {
+	var strictest *Result
+	var strictestLimit config.RateLimitInfo
+
+	for _, limit := range routeLimits {
+		result, err := operation(bucketKey(limit, r), limit.Rate, limit.Burst, now)
+		if err != nil {
+			logger.Log(r).Warn().Msg("Cannot use rate limit bucket: " + err.Error())
+			continue
+		}
+		if strictest == nil || (!result.Allowed && strictest.Allowed) ||
+			(result.Allowed == strictest.Allowed && result.Remaining < strictest.Remaining) {
+			mycopy := result
+			strictest, strictestLimit = &mycopy, limit
+		}
+	}
+	return strictest, strictestLimit
+}
@@ -0,0 +1,126 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maxime1907/crudify/config"
+)
+
+func TestMemoryStoreTake(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		after         time.Duration
+		wantAllowed   bool
+		wantRemaining int
+	}{
+		{"First token of a full bucket", 0, true, 1},
+		{"Last token", 0, true, 0},
+		{"Empty bucket", 0, false, 0},
+		{"Refilled token", time.Second, true, 0},
+		{"Refilled up to burst", time.Minute, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.after)
+			got, err := store.Take("client", 1, 2, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Allowed != tt.wantAllowed || got.Remaining != tt.wantRemaining {
+				t.Errorf("Take() = %+v, want allowed %v and %v remaining", got, tt.wantAllowed, tt.wantRemaining)
+			}
+			if !got.Allowed && got.RetryAfter != time.Second {
+				t.Errorf("Take() retry after %v, want %v", got.RetryAfter, time.Second)
+			}
+		})
+	}
+}
+
+func TestRouteLimits(t *testing.T) {
+	limits := []config.RateLimitInfo{
+		{Per: PerGlobal, Rate: 10, Burst: 20},
+		{Route: "get_crudify", Rate: 1, Burst: 2},
+		{Route: "post_crudify", Rate: 1, Burst: 2},
+		{Route: "get_crudify", Rate: 0, Burst: 2},
+	}
+
+	if got := len(RouteLimits(limits, "get_crudify")); got != 2 {
+		t.Errorf("RouteLimits() of a limited route = %v limits, want 2", got)
+	}
+	if got := len(RouteLimits(limits, "delete_crudify")); got != 1 {
+		t.Errorf("RouteLimits() of another route = %v limits, want 1", got)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	DefaultStore = NewMemoryStore()
+	limits := []config.RateLimitInfo{
+		{Per: PerGlobal, Rate: 1, Burst: 3},
+		{Route: "get_crudify", Per: PerIdentity, Rate: 1, Burst: 1},
+	}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := Limit(inner, "get_crudify", limits)
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		wantStatus    int
+		wantRemaining string
+	}{
+		{"First request of a client", "10.0.0.1:1234", http.StatusOK, "0"},
+		{"Client over its limit", "10.0.0.1:1235", http.StatusTooManyRequests, "0"},
+		{"Other client", "10.0.0.2:1234", http.StatusOK, "0"},
+		{"Refused request took no global token", "10.0.0.3:1234", http.StatusOK, "0"},
+		{"Global limit exhausted", "10.0.0.4:1234", http.StatusTooManyRequests, "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/crudify", nil)
+			req.RemoteAddr = tt.remoteAddr
+			h.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("Limit() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("RateLimit-Remaining"); got != tt.wantRemaining {
+				t.Errorf("Limit() RateLimit-Remaining = %v, want %v", got, tt.wantRemaining)
+			}
+			if tt.wantStatus == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+				t.Errorf("Limit() answered %v without Retry-After", w.Code)
+			}
+		})
+	}
+}
+
+func TestLimitIP(t *testing.T) {
+	DefaultStore = NewMemoryStore()
+	limits := []config.RateLimitInfo{{Per: PerIP, Rate: 1, Burst: 1}}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name       string
+		handler    http.Handler
+		wantStatus int
+	}{
+		{"First request of an IP", LimitIP(inner, "get_crudify", limits), http.StatusOK},
+		{"IP over its limit", LimitIP(inner, "get_crudify", limits), http.StatusTooManyRequests},
+		{"Limits per IP are left out after authentication", Limit(inner, "get_crudify", limits), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "/crudify", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			tt.handler.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("LimitIP() status = %v, want %v", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Result of taking a token from a bucket
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+// Store keeps token buckets, shared deployments implement it on top of a shared database or cache
+// Take removes a token from the bucket of key, refilled with rate tokens per second and holding at most burst tokens,
+// Peek tells the result of Take without removing the token
+type Store interface {
+	Take(key string, rate float64, burst int, now time.Time) (Result, error)
+	Peek(key string, rate float64, burst int, now time.Time) (Result, error)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+// MemoryStore keeps token buckets in memory, they are only shared by the handlers of a single process
+type MemoryStore struct {
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// Interval between removals of buckets that are full again
+const sweepInterval = time.Minute
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}}
+}
+
+// Take removes a token from the bucket of key, creating it full when it does not exist
+func (s *MemoryStore) Take(key string, rate float64, burst int, now time.Time) (Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+
+	mybucket, ok := s.buckets[key]
+	if !ok {
+		mybucket = &bucket{tokens: float64(burst), last: now}
+		s.buckets[key] = mybucket
+	}
+	mybucket.rate, mybucket.burst = rate, burst
+	return TakeToken(&mybucket.tokens, &mybucket.last, rate, burst, now), nil
+}
+
+// Peek tells if a token is available in the bucket of key, a bucket which does not exist is full
+func (s *MemoryStore) Peek(key string, rate float64, burst int, now time.Time) (Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tokens, last := float64(burst), now
+	if mybucket, ok := s.buckets[key]; ok {
+		tokens, last = mybucket.tokens, mybucket.last
+	}
+	return TakeToken(&tokens, &last, rate, burst, now), nil
+}
+
+// Forget buckets that refilled up to burst since their last use, they are recreated full on demand
+func (s *MemoryStore) sweep(now time.Time) {
+	s.lastSweep = now
+	for key, mybucket := range s.buckets {
+		if mybucket.tokens+now.Sub(mybucket.last).Seconds()*mybucket.rate >= float64(mybucket.burst) {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// TakeToken refills a bucket holding tokens since last and removes a token when one is available
+// It is meant for stores that load and save tokens and last themselves
+func TakeToken(tokens *float64, last *time.Time, rate float64, burst int, now time.Time) Result {
+	elapsed := now.Sub(*last).Seconds()
+	if elapsed > 0 {
+		*tokens = math.Min(float64(burst), *tokens+elapsed*rate)
+		*last = now
+	}
+
+	result := Result{Allowed: *tokens >= 1}
+	if result.Allowed {
+		*tokens--
+	} else {
+		result.RetryAfter = secondsToDuration((1 - *tokens) / rate)
+	}
+	result.Remaining = int(math.Floor(*tokens))
+	result.Reset = secondsToDuration((float64(burst) - *tokens) / rate)
+	return result
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
@@ -0,0 +1,134 @@
+package router
+
+import (
+	"net/http"
+
+	"github.com/maxime1907/crudify/auth"
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/logger"
+	"github.com/maxime1907/crudify/metrics"
+	"github.com/maxime1907/crudify/ratelimit"
+	"github.com/maxime1907/crudify/tracing"
+)
+
+// Middleware wraps a handler with a behaviour of its own, calling the inner handler to go on
+type Middleware func(inner http.Handler) http.Handler
+
+// Middlewares wrapping every route added afterwards
+var globalMiddlewares []Middleware
+
+// Use adds middlewares to every route added afterwards, call it before New or AddRoutes
+//
+// Middlewares of a route run in this order, the first one wrapping the others:
+// metrics, tracing, logging and panic recovery, global middlewares, rate limiting per IP, authentication, rate limiting,
+// group middlewares, route middlewares, authorization policies and the handler
+func Use(middlewares ...Middleware) {
+	globalMiddlewares = append(globalMiddlewares, middlewares...)
+}
+
+// Group adds middlewares to routes, they run before the own middlewares of each route
+func Group(routes []Route, middlewares ...Middleware) []Route {
+	grouped := make([]Route, 0, len(routes))
+	for _, route := range routes {
+		routeMiddlewares := append([]Middleware{}, middlewares...)
+		route.Middlewares = append(routeMiddlewares, route.Middlewares...)
+		grouped = append(grouped, route)
+	}
+	return grouped
+}
+
+// Chain wraps a handler with middlewares, the first one being the outermost
+func Chain(h http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
+
+// Logging and panic recovery of a route
+func Logging(name string) Middleware {
+	return func(inner http.Handler) http.Handler {
+		return logger.Logger(inner, name, PanicFuncHandler)
+	}
+}
+
+// Metrics of requests to a route, by status
+func Metrics(name string) Middleware {
+	return func(inner http.Handler) http.Handler {
+		return metrics.Instrument(inner, name)
+	}
+}
+
+// Tracing of requests to a route, continuing the trace of the caller
+func Tracing(name string) Middleware {
+	return func(inner http.Handler) http.Handler {
+		return tracing.Handler(inner, name)
+	}
+}
+
+// Authentication configured in routerinfo: API keys falling back to JWT or else basic auth
+func Authentication(routerinfo config.RouterInfo) Middleware {
+	return func(inner http.Handler) http.Handler {
+		var fallback http.Handler
+
+		if auth.JWTEnabled(routerinfo.JWT) {
+			fallback = auth.JWT(inner, routerinfo.JWT)
+		} else if auth.BasicEnabled(routerinfo) {
+			fallback = auth.BasicAuth(inner, routerinfo)
+		}
+		if auth.APIKeyEnabled(routerinfo.APIKeys) {
+			return auth.APIKey(inner, fallback, routerinfo.APIKeys)
+		}
+		if fallback != nil {
+			return fallback
+		}
+		return inner
+	}
+}
+
+// Rate limiting per IP of a route, before authentication
+func RateLimitIP(name string, limits []config.RateLimitInfo) Middleware {
+	return func(inner http.Handler) http.Handler {
+		return ratelimit.LimitIP(inner, name, limits)
+	}
+}
+
+// Rate limiting of a route
+func RateLimit(name string, limits []config.RateLimitInfo) Middleware {
+	return func(inner http.Handler) http.Handler {
+		return ratelimit.Limit(inner, name, limits)
+	}
+}
+
+// Authorization policies of a table
+func Authorization(tablename string, policies []config.PolicyInfo) Middleware {
+	return func(inner http.Handler) http.Handler {
+		return auth.Authorize(inner, tablename, policies)
+	}
+}
+
+// Middlewares of a route, in the order they run
+func routeMiddlewares(route Route, routerinfo config.RouterInfo) []Middleware {
+	var middlewares []Middleware
+
+	if routerinfo.Metrics.Enabled {
+		middlewares = append(middlewares, Metrics(route.Name))
+	}
+	if tracing.Enabled {
+		middlewares = append(middlewares, Tracing(route.Name))
+	}
+	middlewares = append(middlewares, Logging(route.Name))
+	middlewares = append(middlewares, globalMiddlewares...)
+	if ratelimit.Enabled(routerinfo.RateLimits) {
+		middlewares = append(middlewares, RateLimitIP(route.Name, routerinfo.RateLimits))
+	}
+	middlewares = append(middlewares, Authentication(routerinfo))
+	if ratelimit.Enabled(routerinfo.RateLimits) {
+		middlewares = append(middlewares, RateLimit(route.Name, routerinfo.RateLimits))
+	}
+	middlewares = append(middlewares, route.Middlewares...)
+	if len(routerinfo.Policies) > 0 && route.Doc != nil && route.Doc.Table != "" {
+		middlewares = append(middlewares, Authorization(route.Doc.Table, routerinfo.Policies))
+	}
+	return middlewares
+}
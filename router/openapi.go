@@ -0,0 +1,429 @@
+package router
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/handler"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Information of the generated OpenAPI document, can be changed by embedding applications
+var OpenAPITitle = "crudify"
+var OpenAPIVersion = "1.0.0"
+
+// RouteDoc holds optional OpenAPI metadata of a route
+// Routes on a table are documented from its schema, other fields override what is generated
+type RouteDoc struct {
+	Table       string
+	Summary     string
+	Description string
+	Tags        []string
+	Parameters  []Parameter
+	RequestBody *Schema
+	Response    *Schema
+}
+
+type OpenAPIDocument struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       OpenAPIInfo                      `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type Components struct {
+	Schemas map[string]*Schema `json:"schemas"`
+}
+
+type Operation struct {
+	OperationID string                 `json:"operationId"`
+	Summary     string                 `json:"summary,omitempty"`
+	Description string                 `json:"description,omitempty"`
+	Tags        []string               `json:"tags,omitempty"`
+	Parameters  []Parameter            `json:"parameters,omitempty"`
+	RequestBody *RequestBody           `json:"requestBody,omitempty"`
+	Responses   map[string]ResponseDoc `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema,omitempty"`
+}
+
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+type ResponseDoc struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+type Schema struct {
+	Ref         string             `json:"$ref,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Nullable    bool               `json:"nullable,omitempty"`
+	ReadOnly    bool               `json:"readOnly,omitempty"`
+	MaxLength   int                `json:"maxLength,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	OneOf       []*Schema          `json:"oneOf,omitempty"`
+}
+
+// Query arguments documented on generic routes, by method
+var queryArguments = map[string][]Parameter{
+	"GET": {
+		{Name: "_limit", In: "query", Description: "Maximum number of rows returned", Schema: &Schema{Type: "integer", Format: "int64"}},
+		{Name: "_orderby", In: "query", Description: "Column to sort on, _rank to sort by search relevance", Schema: &Schema{Type: "string"}},
+		{Name: "_order", In: "query", Description: "Ascending order when true, descending when false", Schema: &Schema{Type: "string", Enum: []string{"true", "false"}}},
+		{Name: "_only", In: "query", Description: "Skip inherited tables", Schema: &Schema{Type: "string"}},
+		{Name: "_nested", In: "query", Description: "Embed rows referenced by foreign keys", Schema: &Schema{Type: "string"}},
+		{Name: "_select", In: "query", Description: "Columns and aggregates like count(), sum(column), non-aggregate columns are grouped", Schema: &Schema{Type: "string"}},
+		{Name: "_having", In: "query", Description: "Conditions on aggregates like count()>5", Schema: &Schema{Type: "string"}},
+		{Name: "_search", In: "query", Description: "Full-text search terms", Schema: &Schema{Type: "string"}},
+		{Name: "_search_columns", In: "query", Description: "Text columns to search on", Schema: &Schema{Type: "string"}},
+		{Name: "_stream", In: "query", Description: "Stream rows as they are read", Schema: &Schema{Type: "string", Enum: []string{handler.StreamJSON, handler.StreamNDJSON, handler.StreamCSV}}},
+	},
+	"POST": {
+		{Name: "_returning", In: "query", Description: "Column returned after insert", Schema: &Schema{Type: "string"}},
+	},
+}
+
+// Methods whose columns can be given as query arguments to filter rows
+var filterMethods = map[string]bool{
+	"GET":    true,
+	"DELETE": true,
+}
+
+// Summary of generated operations, by method
+var methodSummaries = map[string]string{
+	"GET":    "Select",
+	"POST":   "Insert",
+	"PUT":    "Update",
+	"DELETE": "Delete",
+}
+
+// Methods taking rows as body
+var bodyMethods = map[string]bool{
+	"POST": true,
+	"PUT":  true,
+}
+
+// OpenAPIHandler returns a handler answering the OpenAPI document of routes
+func OpenAPIHandler(routes []Route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		doc, err := BuildOpenAPI(r, routes)
+		if err != nil {
+			logger.Log(r).Warn().Msg(err.Error())
+			err = handler.SendAnswer(w, r, nil, err)
+		} else {
+			w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+			err = handler.EncodeJSON(w, r, doc)
+		}
+		if err != nil {
+			logger.Log(r).Warn().Msg(err.Error())
+		}
+	}
+}
+
+// BuildOpenAPI generates an OpenAPI 3 document from routes and the schema of their tables
+func BuildOpenAPI(r *http.Request, routes []Route) (*OpenAPIDocument, error) {
+	logger.Log(r).Debug().Msg("Building OpenAPI document")
+
+	doc := &OpenAPIDocument{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: OpenAPITitle, Version: OpenAPIVersion},
+		Paths:   map[string]map[string]*Operation{},
+		Components: Components{Schemas: map[string]*Schema{
+			"Response": envelopeSchema(&Schema{}),
+			"Problem":  problemSchema(),
+		}},
+	}
+
+	for _, route := range routes {
+		path, pathParams := OpenAPIPath(route.Pattern)
+		operation := &Operation{
+			OperationID: route.Name,
+			Responses: map[string]ResponseDoc{
+				"default": {Description: "Error", Content: errorContent()},
+			},
+		}
+		if route.Doc != nil && route.Doc.Table != "" {
+			err := documentTable(r, doc, operation, route, pathParams)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			operation.Responses["200"] = ResponseDoc{Description: "Success", Content: jsonContent(responseSchema(&Schema{}))}
+		}
+		if route.Doc != nil {
+			documentCustom(operation, *route.Doc)
+		}
+
+		for _, name := range pathParams {
+			if !hasParameter(operation.Parameters, name, "path") {
+				operation.Parameters = append(operation.Parameters, Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+			}
+		}
+
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = map[string]*Operation{}
+		}
+		doc.Paths[path][strings.ToLower(route.Method)] = operation
+	}
+	return doc, nil
+}
+
+// OpenAPIPath converts a mux pattern into an OpenAPI path and returns its parameter names
+func OpenAPIPath(pattern string) (string, []string) {
+	var path string
+	var params []string
+
+	for {
+		start := strings.Index(pattern, "{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(pattern[start:], "}")
+		if end < 0 {
+			break
+		}
+		name := pattern[start+1 : start+end]
+		if pos := strings.Index(name, ":"); pos > -1 {
+			name = name[:pos]
+		}
+		params = append(params, name)
+		path += pattern[:start] + "{" + name + "}"
+		pattern = pattern[start+end+1:]
+	}
+	return path + pattern, params
+}
+
+// Fill an operation from the schema of its table
+func documentTable(r *http.Request, doc *OpenAPIDocument, operation *Operation, route Route, pathParams []string) error {
+	tablename := route.Doc.Table
+	tablecolumns, err := dbhelper.GetColumns(r, tablename)
+	if err != nil {
+		return err
+	}
+	if _, ok := doc.Components.Schemas[tablename]; !ok {
+		doc.Components.Schemas[tablename], doc.Components.Schemas[tablename+"_row"] = tableSchemas(tablename, tablecolumns)
+	}
+	tableRef := &Schema{Ref: "#/components/schemas/" + tablename}
+	rowRef := &Schema{Ref: "#/components/schemas/" + tablename + "_row"}
+
+	operation.Tags = []string{tablename}
+	operation.Summary = methodSummaries[route.Method] + " rows of " + tablename
+
+	for _, name := range pathParams {
+		if column, ok := tablecolumns[name]; ok {
+			operation.Parameters = append(operation.Parameters, Parameter{Name: name, In: "path", Required: true, Schema: columnSchema(column)})
+		}
+	}
+	if filterMethods[route.Method] {
+		for _, name := range sortedColumns(tablecolumns) {
+			if !hasParameter(operation.Parameters, name, "path") {
+				operation.Parameters = append(operation.Parameters, Parameter{Name: name, In: "query", Description: "Equality filter", Schema: columnSchema(tablecolumns[name])})
+			}
+		}
+	}
+	operation.Parameters = append(operation.Parameters, queryArguments[route.Method]...)
+
+	if bodyMethods[route.Method] {
+		operation.RequestBody = &RequestBody{
+			Required: true,
+			Content: map[string]MediaType{
+				handler.ContentTypeJSON:   {Schema: &Schema{OneOf: []*Schema{tableRef, {Type: "array", Items: tableRef}}}},
+				handler.ContentTypeNDJSON: {Schema: &Schema{Type: "string", Description: "One " + tablename + " object per line"}},
+				handler.ContentTypeCSV:    {Schema: &Schema{Type: "string", Description: "Header row of " + tablename + " columns followed by rows"}},
+			},
+		}
+	}
+
+	if bodyMethods[route.Method] {
+		operation.Responses["422"] = ResponseDoc{Description: "Invalid rows, error details list every invalid field", Content: errorContent()}
+	}
+
+	success := ResponseDoc{Description: "Success", Content: jsonContent(responseSchema(&Schema{Type: "array", Items: rowRef}))}
+	if route.Method == "GET" {
+		success.Content[handler.ContentTypeNDJSON] = MediaType{Schema: &Schema{Type: "string", Description: "One row per line"}}
+		success.Content[handler.ContentTypeCSV] = MediaType{Schema: &Schema{Type: "string", Description: "Header row followed by rows"}}
+	}
+	operation.Responses["200"] = success
+	return nil
+}
+
+// Override a generated operation with metadata declared on its route
+func documentCustom(operation *Operation, routeDoc RouteDoc) {
+	if routeDoc.Summary != "" {
+		operation.Summary = routeDoc.Summary
+	}
+	if routeDoc.Description != "" {
+		operation.Description = routeDoc.Description
+	}
+	if len(routeDoc.Tags) > 0 {
+		operation.Tags = routeDoc.Tags
+	}
+	operation.Parameters = append(operation.Parameters, routeDoc.Parameters...)
+	if routeDoc.RequestBody != nil {
+		operation.RequestBody = &RequestBody{Required: true, Content: jsonContent(routeDoc.RequestBody)}
+	}
+	if routeDoc.Response != nil {
+		operation.Responses["200"] = ResponseDoc{Description: "Success", Content: jsonContent(envelopeSchema(routeDoc.Response))}
+	}
+}
+
+// Schemas of a table, the first one describes rows sent and the second one rows received
+// Received values are always strings, their database type is given as format
+func tableSchemas(tablename string, tablecolumns map[string]dbhelper.Column) (*Schema, *Schema) {
+	table := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	row := &Schema{Type: "object", Properties: map[string]*Schema{}}
+
+	for _, name := range sortedColumns(tablecolumns) {
+		column := tablecolumns[name]
+		if dbhelper.IsHidden(tablename, name) {
+			continue
+		}
+		readOnly := dbhelper.IsReadOnly(tablename, name)
+		table.Properties[name] = columnSchema(column)
+		table.Properties[name].ReadOnly = readOnly
+		row.Properties[name] = &Schema{Type: "string", Format: column.Type, Nullable: column.Nullable, ReadOnly: readOnly}
+		if !column.Nullable && !column.HasDefault && !readOnly {
+			table.Required = append(table.Required, name)
+		}
+	}
+	return table, row
+}
+
+// Convert a column type into its OpenAPI schema
+func columnSchema(column dbhelper.Column) *Schema {
+	schema := &Schema{Nullable: column.Nullable}
+
+	switch column.Type {
+	case "smallint", "integer":
+		schema.Type, schema.Format = "integer", "int32"
+	case "bigint":
+		schema.Type, schema.Format = "integer", "int64"
+	case "numeric", "decimal", "real", "double precision", "money":
+		schema.Type = "number"
+	case "boolean":
+		schema.Type = "boolean"
+	case "date":
+		schema.Type, schema.Format = "string", "date"
+	case "timestamp without time zone", "timestamp with time zone":
+		schema.Type, schema.Format = "string", "date-time"
+	case "uuid":
+		schema.Type, schema.Format = "string", "uuid"
+	case "json", "jsonb":
+		schema.Description = column.Type
+	case "ARRAY":
+		schema.Type, schema.Items = "array", &Schema{}
+	default:
+		schema.Type = "string"
+		schema.MaxLength = column.MaxLength
+		if !column.IsText() {
+			schema.Format = column.Type
+		}
+	}
+	return schema
+}
+
+// Response envelope holding data of the given schema
+func envelopeSchema(data *Schema) *Schema {
+	return &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"uuid":    {Type: "string", Format: "uuid"},
+			"time":    {Type: "string", Format: "date-time"},
+			"message": {Type: "string"},
+			"data":    data,
+			"error": {
+				Type: "object",
+				Properties: map[string]*Schema{
+					"code":       {Type: "string"},
+					"table":      {Type: "string"},
+					"column":     {Type: "string"},
+					"constraint": {Type: "string"},
+					"details":    {},
+				},
+			},
+		},
+	}
+}
+
+// Problem details sent instead of the envelope for errors
+func problemSchema() *Schema {
+	return &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"type":       {Type: "string"},
+			"title":      {Type: "string"},
+			"status":     {Type: "integer"},
+			"detail":     {Type: "string"},
+			"instance":   {Type: "string"},
+			"code":       {Type: "string"},
+			"table":      {Type: "string"},
+			"column":     {Type: "string"},
+			"constraint": {Type: "string"},
+			"details":    {},
+		},
+	}
+}
+
+// Success responses hold data in the envelope unless answers are bare
+func responseSchema(data *Schema) *Schema {
+	if handler.Responses.Bare {
+		return data
+	}
+	return envelopeSchema(data)
+}
+
+// Errors are sent in the envelope, or as problem details when configured or accepted
+func errorContent() map[string]MediaType {
+	content := map[string]MediaType{handler.ContentTypeProblem: {Schema: &Schema{Ref: "#/components/schemas/Problem"}}}
+	if !handler.Responses.Problem {
+		content[handler.ContentTypeJSON] = MediaType{Schema: &Schema{Ref: "#/components/schemas/Response"}}
+	}
+	return content
+}
+
+func jsonContent(schema *Schema) map[string]MediaType {
+	return map[string]MediaType{handler.ContentTypeJSON: {Schema: schema}}
+}
+
+func hasParameter(parameters []Parameter, name string, in string) bool {
+	for _, parameter := range parameters {
+		if parameter.Name == name && parameter.In == in {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedColumns(tablecolumns map[string]dbhelper.Column) []string {
+	names := make([]string, 0, len(tablecolumns))
+	for name := range tablecolumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
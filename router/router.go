@@ -1,7 +1,7 @@
 package router
 
 import (
-	"crypto/tls"
+	"context"
 	"errors"
 	"fmt"
 	"net"
@@ -17,7 +17,7 @@ import (
 	"github.com/maxime1907/crudify/dbhelper"
 	"github.com/maxime1907/crudify/handler"
 	"github.com/maxime1907/crudify/logger"
-	"github.com/maxime1907/crudify/auth"
+	"github.com/maxime1907/crudify/metrics"
 )
 
 type Route struct {
@@ -25,6 +25,8 @@ type Route struct {
 	Method      string
 	Pattern     string
 	HandlerFunc http.HandlerFunc
+	Doc         *RouteDoc
+	Middlewares []Middleware
 }
 
 type RouteHelper struct {
@@ -53,6 +55,7 @@ func PanicFuncHandler(w http.ResponseWriter, r *http.Request, name string, start
 			err = errors.New("Unknown panic")
 		}
 		logger.Log(r).Error().Str("stacktrace", identifyPanic()).Msg(err.Error())
+		metrics.Panics.Inc(name)
 		err = handler.SendAnswer(w, r, nil, err)
 		if err != nil {
 			logger.Log(r).Error().Msg(err.Error())
@@ -106,13 +109,7 @@ func identifyPanic() string {
 func AddRoute(router *mux.Router, route Route, routerinfo config.RouterInfo) {
 	var handler http.Handler
 
-	handler = route.HandlerFunc
-
-	if (routerinfo.Username != "" && routerinfo.Password != "") {
-		handler = auth.BasicAuth(handler, routerinfo)
-	}
-
-	handler = logger.Logger(handler, route.Name, PanicFuncHandler)
+	handler = Chain(route.HandlerFunc, routeMiddlewares(route, routerinfo)...)
 
 	router.
 		Methods(route.Method).
@@ -145,24 +142,59 @@ func GetCRUD(gethandler http.HandlerFunc, posthandler http.HandlerFunc,
 			Pattern:     "/" + value,
 			Name:        "get_" + value,
 			HandlerFunc: gethandler,
+			Doc:         &RouteDoc{Table: value},
 		})
 		routes = append(routes, Route{
 			Method:      "POST",
 			Pattern:     "/" + value,
 			Name:        "post_" + value,
 			HandlerFunc: posthandler,
+			Doc:         &RouteDoc{Table: value},
 		})
 		routes = append(routes, Route{
 			Method:      "PUT",
 			Pattern:     "/" + value,
 			Name:        "put_" + value,
 			HandlerFunc: puthandler,
+			Doc:         &RouteDoc{Table: value},
 		})
 		routes = append(routes, Route{
 			Method:      "DELETE",
 			Pattern:     "/" + value,
 			Name:        "delete_" + value,
 			HandlerFunc: deletehandler,
+			Doc:         &RouteDoc{Table: value},
+		})
+
+		// Single row routes identified by primary keys
+		keys, err := dbhelper.GetPrimaryKeys(nil, value)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) <= 0 {
+			continue
+		}
+		pattern := "/" + value + "/{" + strings.Join(keys, "}/{") + "}"
+		routes = append(routes, Route{
+			Method:      "GET",
+			Pattern:     pattern,
+			Name:        "get_" + value + "_item",
+			HandlerFunc: gethandler,
+			Doc:         &RouteDoc{Table: value},
+		})
+		routes = append(routes, Route{
+			Method:      "PUT",
+			Pattern:     pattern,
+			Name:        "put_" + value + "_item",
+			HandlerFunc: puthandler,
+			Doc:         &RouteDoc{Table: value},
+		})
+		routes = append(routes, Route{
+			Method:      "DELETE",
+			Pattern:     pattern,
+			Name:        "delete_" + value + "_item",
+			HandlerFunc: deletehandler,
+			Doc:         &RouteDoc{Table: value},
 		})
 	}
 	return &routes, nil
@@ -201,8 +233,6 @@ func New(custom_routes *[]Route, enableCRUD bool, enableRootGet bool, routerinfo
 	var root_get_explicit *Route = nil
 	var err error
 
-	router := mux.NewRouter().StrictSlash(true)
-
 	if enableCRUD {
 		crud_routes, err = GetCRUD(handler.Get, handler.Post, handler.Put, handler.Delete)
 		if err != nil {
@@ -219,7 +249,37 @@ func New(custom_routes *[]Route, enableCRUD bool, enableRootGet bool, routerinfo
 		};
 	}
 
-	NewCustom(custom_routes, crud_routes, root_get_explicit, routerinfo)
+	router := NewCustom(custom_routes, crud_routes, root_get_explicit, routerinfo)
+
+	if enableRootGet {
+		// Only routes served by this router are documented
+		var documented []Route
+		if custom_routes != nil {
+			documented = append(documented, *custom_routes...)
+		}
+		if crud_routes != nil {
+			documented = append(documented, *crud_routes...)
+		}
+		AddRoute(router, Route{
+			Method:      "GET",
+			Pattern:     "/openapi.json",
+			Name:        "openapi_get",
+			HandlerFunc: OpenAPIHandler(documented),
+		}, routerinfo)
+	}
+
+	if routerinfo.Metrics.Enabled {
+		path := routerinfo.Metrics.Path
+		if path == "" {
+			path = "/metrics"
+		}
+		AddRoute(router, Route{
+			Method:      "GET",
+			Pattern:     path,
+			Name:        "metrics_get",
+			HandlerFunc: metrics.MetricsGet,
+		}, routerinfo)
+	}
 
 	return router
 }
@@ -233,24 +293,11 @@ func Run(h http.Handler, port int) error {
 func RunWithTLS(h http.Handler, port int, tlsconf config.TLSInfo) error {
 	port_s := strconv.Itoa(port)
 	logger.Log(nil).Info().Msg("Listening and serving on port " + port_s + " with TLS")
-	cfg := &tls.Config{
-		MinVersion:               tls.VersionTLS12,
-		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
-		PreferServerCipherSuites: true,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-		},
-	}
-	srv := &http.Server{
-		Addr:         ":" + port_s,
-		Handler:      h,
-		TLSConfig:    cfg,
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
+	srv, err := newTLSServer(context.Background(), h, ":"+port_s, tlsconf)
+	if err != nil {
+		return err
 	}
-	return srv.ListenAndServeTLS(tlsconf.Crt, tlsconf.Key)
+	return srv.ListenAndServeTLS("", "")
 }
 
 func getPort(l net.Listener) string {
@@ -267,3 +314,12 @@ func RunWithListener(h http.Handler, l net.Listener) error {
 	logger.Log(nil).Info().Msg("Serving with custom listener on port " + getPort(l))
 	return http.Serve(l, h)
 }
+
+func RunWithTLSListener(h http.Handler, l net.Listener, tlsconf config.TLSInfo) error {
+	logger.Log(nil).Info().Msg("Serving with custom listener on port " + getPort(l) + " with TLS")
+	srv, err := newTLSServer(context.Background(), h, l.Addr().String(), tlsconf)
+	if err != nil {
+		return err
+	}
+	return srv.ServeTLS(l, "", "")
+}
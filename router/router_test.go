@@ -1,12 +1,30 @@
 package router
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/maxime1907/crudify/config"
 	"github.com/maxime1907/crudify/dbhelper"
+	"golang.org/x/net/http2"
 )
 
 var configuration = config.DBInfo{
@@ -29,7 +47,7 @@ func TestNew(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			router := New(nil, true, true)
+			router := New(nil, true, true, config.RouterInfo{})
 			if router == nil {
 				t.Errorf("New() = %v", router)
 			}
@@ -50,7 +68,7 @@ func TestRun(t *testing.T) {
 		{
 			name: "Running router",
 			args: args{
-				r:    New(nil, true, true),
+				r:    New(nil, true, true, config.RouterInfo{}),
 				port: 8080,
 			},
 		},
@@ -72,3 +90,391 @@ func TestRun(t *testing.T) {
 		})
 	}
 }
+
+func TestOpenAPIPath(t *testing.T) {
+	tests := []struct {
+		name       string
+		pattern    string
+		wantPath   string
+		wantParams []string
+	}{
+		{
+			name:     "Without parameters",
+			pattern:  "/crudify",
+			wantPath: "/crudify",
+		},
+		{
+			name:       "With regular expressions",
+			pattern:    "/crudify/{id:[0-9]+}/items/{label}",
+			wantPath:   "/crudify/{id}/items/{label}",
+			wantParams: []string{"id", "label"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, params := OpenAPIPath(tt.pattern)
+			if path != tt.wantPath {
+				t.Errorf("OpenAPIPath() path = %v, want %v", path, tt.wantPath)
+			}
+			if !reflect.DeepEqual(params, tt.wantParams) {
+				t.Errorf("OpenAPIPath() params = %v, want %v", params, tt.wantParams)
+			}
+		})
+	}
+}
+
+func TestBuildOpenAPI(t *testing.T) {
+	routes := []Route{
+		{
+			Name:        "custom_get",
+			Method:      "GET",
+			Pattern:     "/custom/{id:[0-9]+}",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {},
+			Doc: &RouteDoc{
+				Summary:  "Custom route",
+				Response: &Schema{Type: "object"},
+			},
+		},
+		{
+			Name:        "undocumented_post",
+			Method:      "POST",
+			Pattern:     "/undocumented",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) {},
+		},
+	}
+	doc, err := BuildOpenAPI(nil, routes)
+	if err != nil {
+		t.Fatalf("BuildOpenAPI() error = %v", err)
+	}
+	operation := doc.Paths["/custom/{id}"]["get"]
+	if operation == nil || operation.Summary != "Custom route" {
+		t.Fatalf("BuildOpenAPI() custom operation = %v", operation)
+	}
+	if len(operation.Parameters) != 1 || operation.Parameters[0].In != "path" || !operation.Parameters[0].Required {
+		t.Errorf("BuildOpenAPI() custom parameters = %v", operation.Parameters)
+	}
+	if doc.Paths["/undocumented"]["post"] == nil {
+		t.Errorf("BuildOpenAPI() missing undocumented route")
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	first := New(&[]Route{{Name: "first_get", Method: "GET", Pattern: "/first", HandlerFunc: noop}}, false, true, config.RouterInfo{})
+	New(&[]Route{{Name: "second_get", Method: "GET", Pattern: "/second", HandlerFunc: noop}}, false, true, config.RouterInfo{})
+
+	w := httptest.NewRecorder()
+	first.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	var doc OpenAPIDocument
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("OpenAPIHandler() answered %v: %v", w.Body.String(), err)
+	}
+	if len(doc.Paths) != 1 || doc.Paths["/first"]["get"] == nil {
+		t.Errorf("OpenAPIHandler() paths = %v, want only /first", doc.Paths)
+	}
+}
+
+// Write a self-signed certificate and its key in dir, returning their paths
+func writeCertificate(t *testing.T, dir string, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt := filepath.Join(dir, "server.crt")
+	keyfile := filepath.Join(dir, "server.key")
+	err = ioutil.WriteFile(crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt, keyfile
+}
+
+// Common name of the certificate served by a reloader
+func servedName(t *testing.T, reloader *CertificateReloader) string {
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	crt, key := writeCertificate(t, dir, "first")
+
+	reloader, err := NewCertificateReloader(crt, key)
+	if err != nil {
+		t.Fatalf("NewCertificateReloader() error = %v", err)
+	}
+	if got := servedName(t, reloader); got != "first" {
+		t.Errorf("GetCertificate() = %v, want first", got)
+	}
+
+	writeCertificate(t, dir, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(crt, later, later)
+	os.Chtimes(key, later, later)
+	reloader.Check()
+	if got := servedName(t, reloader); got != "second" {
+		t.Errorf("GetCertificate() after change = %v, want second", got)
+	}
+
+	ioutil.WriteFile(crt, []byte("not a certificate"), 0600)
+	os.Chtimes(crt, later.Add(time.Minute), later.Add(time.Minute))
+	reloader.Check()
+	if got := servedName(t, reloader); got != "second" {
+		t.Errorf("GetCertificate() after invalid change = %v, want second", got)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	crt, key := writeCertificate(t, dir, "server")
+
+	cfg, err := TLSConfig(context.Background(), config.TLSInfo{Crt: crt, Key: key, ClientCA: crt})
+	if err != nil {
+		t.Fatalf("TLSConfig() error = %v", err)
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert || cfg.ClientCAs == nil {
+		t.Errorf("TLSConfig() client auth = %v, want client certificates verified", cfg.ClientAuth)
+	}
+
+	_, err = TLSConfig(context.Background(), config.TLSInfo{Crt: crt, Key: key, ClientCA: key})
+	if err == nil {
+		t.Errorf("TLSConfig() with a bundle without certificate error = nil")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		name      string
+		httpsPort string
+		target    string
+		want      string
+	}{
+		{"Default port", "443", "http://example.com:8081/crudify?id=1", "https://example.com/crudify?id=1"},
+		{"Other port", "8443", "http://example.com/crudify", "https://example.com:8443/crudify"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			RedirectToHTTPS(tt.httpsPort).ServeHTTP(w, httptest.NewRequest("GET", tt.target, nil))
+			if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tt.want {
+				t.Errorf("RedirectToHTTPS() = %v %v, want %v", w.Code, w.Header().Get("Location"), tt.want)
+			}
+		})
+	}
+}
+
+// Serve a handler over TLS on a local port, returning its URL
+func serveTLS(t *testing.T, h http.Handler, tlsconf config.TLSInfo) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	srv, err := newTLSServer(ctx, h, l.Addr().String(), tlsconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(l, "", "")
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + l.Addr().String()
+}
+
+func TestTLSProfiles(t *testing.T) {
+	dir := t.TempDir()
+	crt, key := writeCertificate(t, dir, "server")
+	bundle, err := ioutil.ReadFile(crt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(bundle)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		name           string
+		profile        string
+		maxVersion     uint16
+		wantProto      int
+		wantTLSVersion uint16
+		wantErr        bool
+	}{
+		{"Intermediate over TLS 1.3", "", 0, 2, tls.VersionTLS13, false},
+		{"Intermediate over TLS 1.2", ProfileIntermediate, tls.VersionTLS12, 2, tls.VersionTLS12, false},
+		{"Modern over TLS 1.3", ProfileModern, 0, 2, tls.VersionTLS13, false},
+		{"Modern over TLS 1.2", ProfileModern, tls.VersionTLS12, 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := serveTLS(t, h, config.TLSInfo{Crt: crt, Key: key, Profile: tt.profile})
+			client := &http.Client{Transport: &http.Transport{
+				TLSClientConfig:   &tls.Config{RootCAs: pool, MaxVersion: tt.maxVersion},
+				ForceAttemptHTTP2: true,
+			}}
+			resp, err := client.Get(url)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			resp.Body.Close()
+			if resp.ProtoMajor != tt.wantProto || resp.TLS.Version != tt.wantTLSVersion {
+				t.Errorf("Get() = HTTP/%v over TLS %x, want HTTP/%v over TLS %x", resp.ProtoMajor, resp.TLS.Version, tt.wantProto, tt.wantTLSVersion)
+			}
+		})
+	}
+
+	_, err = TLSConfig(context.Background(), config.TLSInfo{Crt: crt, Key: key, Profile: "old"})
+	if err == nil {
+		t.Errorf("TLSConfig() with an unknown profile error = nil")
+	}
+}
+
+func TestH2C(t *testing.T) {
+	srv := httptest.NewServer(H2C(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network string, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Get() = HTTP/%v, want HTTP/2", resp.ProtoMajor)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	srv := NewServer(nil, ":8080", config.RouterInfo{Timeouts: config.TimeoutInfo{Read: 5, Write: 10, Idle: 60}})
+	if srv.ReadTimeout != 5*time.Second || srv.WriteTimeout != 10*time.Second || srv.IdleTimeout != time.Minute {
+		t.Errorf("NewServer() timeouts = %v %v %v", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+	if got := ShutdownTimeout(config.RouterInfo{}); got != DefaultShutdownTimeout {
+		t.Errorf("ShutdownTimeout() = %v, want %v", got, DefaultShutdownTimeout)
+	}
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	srv := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		time.Sleep(100 * time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+	}), l.Addr().String(), config.RouterInfo{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error)
+	go func() {
+		served <- Serve(ctx, srv, l, time.Second)
+	}()
+
+	answered := make(chan int)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			answered <- 0
+			return
+		}
+		resp.Body.Close()
+		answered <- resp.StatusCode
+	}()
+
+	<-started
+	cancel()
+	if got := <-answered; got != http.StatusTeapot {
+		t.Errorf("In-flight request status = %v, want %v", got, http.StatusTeapot)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve() error = %v", err)
+	}
+	if _, err := http.Get("http://" + l.Addr().String()); err == nil {
+		t.Errorf("Get() after shutdown error = nil")
+	}
+}
+
+// Middleware recording its name when it runs
+func recordMiddleware(calls *[]string, name string) Middleware {
+	return func(inner http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*calls = append(*calls, name)
+			inner.ServeHTTP(w, r)
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls = append(calls, "handler")
+	}), recordMiddleware(&calls, "first"), recordMiddleware(&calls, "second"))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if want := []string{"first", "second", "handler"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("Chain() calls = %v, want %v", calls, want)
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	var calls []string
+	Use(recordMiddleware(&calls, "global"))
+	defer func() { globalMiddlewares = nil }()
+
+	routes := Group([]Route{
+		{
+			Name:        "custom_get",
+			Method:      "GET",
+			Pattern:     "/custom",
+			HandlerFunc: func(w http.ResponseWriter, r *http.Request) { calls = append(calls, "handler") },
+			Middlewares: []Middleware{recordMiddleware(&calls, "route")},
+		},
+	}, recordMiddleware(&calls, "group"))
+
+	myrouter := mux.NewRouter()
+	AddRoute(myrouter, routes[0], config.RouterInfo{})
+	myrouter.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/custom", nil))
+	if want := []string{"global", "group", "route", "handler"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("AddRoute() calls = %v, want %v", calls, want)
+	}
+}
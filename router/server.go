@@ -0,0 +1,62 @@
+package router
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Time given to in-flight requests on shutdown when no timeout is configured
+const DefaultShutdownTimeout = 30 * time.Second
+
+// NewServer returns a server for a handler with the timeouts of routerinfo
+func NewServer(h http.Handler, addr string, routerinfo config.RouterInfo) *http.Server {
+	return &http.Server{
+		Addr:         addr,
+		Handler:      h,
+		ReadTimeout:  time.Duration(routerinfo.Timeouts.Read) * time.Second,
+		WriteTimeout: time.Duration(routerinfo.Timeouts.Write) * time.Second,
+		IdleTimeout:  time.Duration(routerinfo.Timeouts.Idle) * time.Second,
+	}
+}
+
+// ShutdownTimeout returns the time given to in-flight requests on shutdown
+func ShutdownTimeout(routerinfo config.RouterInfo) time.Duration {
+	if routerinfo.Timeouts.Shutdown > 0 {
+		return time.Duration(routerinfo.Timeouts.Shutdown) * time.Second
+	}
+	return DefaultShutdownTimeout
+}
+
+// Serve serves on a listener until ctx is done, over TLS when srv has a TLS configuration
+// Then it stops accepting connections and waits at most timeout for in-flight requests to finish
+func Serve(ctx context.Context, srv *http.Server, l net.Listener, timeout time.Duration) error {
+	served := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			served <- srv.ServeTLS(l, "", "")
+		} else {
+			served <- srv.Serve(l)
+		}
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Log(nil).Info().Msg("Shutting down server on port " + getPort(l))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(shutdownCtx)
+	if err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package router
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/logger"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// TLSEnabled tells if a certificate and its key are configured
+func TLSEnabled(tlsconf config.TLSInfo) bool {
+	return tlsconf.Crt != "" && tlsconf.Key != ""
+}
+
+// CertificateReloader serves a certificate and its key, loaded again whenever one of their files changes
+type CertificateReloader struct {
+	crt     string
+	key     string
+	mutex   sync.RWMutex
+	cert    *tls.Certificate
+	crtTime time.Time
+	keyTime time.Time
+}
+
+// NewCertificateReloader loads a certificate and its key from PEM files
+func NewCertificateReloader(crt string, key string) (*CertificateReloader, error) {
+	reloader := &CertificateReloader{crt: crt, key: key}
+	err := reloader.reload()
+	if err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Modification times of the certificate and key files
+func (c *CertificateReloader) modTimes() (time.Time, time.Time, error) {
+	crtInfo, err := os.Stat(c.crt)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyInfo, err := os.Stat(c.key)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return crtInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (c *CertificateReloader) reload() error {
+	crtTime, keyTime, err := c.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.crt, c.key)
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert, c.crtTime, c.keyTime = &cert, crtTime, keyTime
+	return nil
+}
+
+// Interval between two checks of the certificate and key files
+var CertificateCheckInterval = 10 * time.Second
+
+// Check loads the certificate again when its files changed
+// A certificate that cannot be reloaded, while files are being replaced for example, is served until it can
+func (c *CertificateReloader) Check() {
+	crtTime, keyTime, err := c.modTimes()
+
+	c.mutex.RLock()
+	changed := err == nil && (!crtTime.Equal(c.crtTime) || !keyTime.Equal(c.keyTime))
+	c.mutex.RUnlock()
+
+	if changed {
+		logger.Log(nil).Info().Msg("Reloading certificate " + c.crt)
+		err = c.reload()
+		if err != nil {
+			logger.Log(nil).Warn().Msg("Cannot reload certificate: " + err.Error())
+		}
+	}
+}
+
+// Watch checks the certificate files at every interval until the context is done
+func (c *CertificateReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Check()
+		}
+	}
+}
+
+// GetCertificate returns the last certificate loaded
+func (c *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+// TLS profiles following the Mozilla server side TLS recommendations
+const (
+	ProfileModern       = "modern"
+	ProfileIntermediate = "intermediate"
+)
+
+// Cipher suites of the intermediate profile for TLS 1.2, TLS 1.3 suites are not configurable
+var intermediateCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// TLSConfig returns the configuration serving the configured certificate over HTTP/2 and HTTP/1.1,
+// its files are checked for changes until the context is done
+// The modern profile only accepts TLS 1.3, the intermediate profile (default) also accepts TLS 1.2 with AEAD ECDHE suites
+// When a CA bundle is configured, clients must present a certificate it signed
+func TLSConfig(ctx context.Context, tlsconf config.TLSInfo) (*tls.Config, error) {
+	cfg := &tls.Config{
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		NextProtos:       []string{"h2", "http/1.1"},
+	}
+	switch tlsconf.Profile {
+	case ProfileModern:
+		cfg.MinVersion = tls.VersionTLS13
+	case ProfileIntermediate, "":
+		cfg.MinVersion = tls.VersionTLS12
+		cfg.CipherSuites = intermediateCipherSuites
+	default:
+		return nil, errors.New("Unknown TLS profile " + tlsconf.Profile)
+	}
+
+	reloader, err := NewCertificateReloader(tlsconf.Crt, tlsconf.Key)
+	if err != nil {
+		return nil, err
+	}
+	cfg.GetCertificate = reloader.GetCertificate
+	go reloader.Watch(ctx, CertificateCheckInterval)
+
+	if tlsconf.ClientCA != "" {
+		bundle, err := ioutil.ReadFile(tlsconf.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("No certificate found in " + tlsconf.ClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// Server serving a handler over TLS
+func newTLSServer(ctx context.Context, h http.Handler, addr string, tlsconf config.TLSInfo) (*http.Server, error) {
+	cfg, err := TLSConfig(ctx, tlsconf)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Server{
+		Addr:      addr,
+		Handler:   h,
+		TLSConfig: cfg,
+	}, nil
+}
+
+// H2C serves HTTP/2 without TLS to clients with prior knowledge or upgrading, behind a proxy terminating TLS
+func H2C(h http.Handler) http.Handler {
+	return h2c.NewHandler(h, &http2.Server{})
+}
+
+// RedirectToHTTPS answers every request with a permanent redirect to the same URL on the HTTPS port
+func RedirectToHTTPS(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
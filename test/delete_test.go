@@ -41,4 +41,12 @@ func testDeleteAllTest(t *testing.T) {
 	if err != nil {
 		t.Fatal(err.Error())
 	}
+	req, err = http.NewRequest("DELETE", url+"crudify?id=-4", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = execRequest(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
 }
@@ -93,6 +93,7 @@ func launchTests(t *testing.T) {
 	waitRouter(t)
 	testPostSingle(t)
 	testPostMultiple(t)
+	testPostNested(t)
 	testPutSingle(t)
 	testPutMultiple(t)
 	testRoot(t)
@@ -54,3 +54,31 @@ func testPostMultiple(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func testPostNested(t *testing.T) {
+	var jsonStr = []byte(`
+		{
+			"id" : "-4",
+			"name" : "testPostNestedIssou",
+			"creation" : "2017-02-10",
+			"description" : "salut tout le monde",
+			"admin" : false,
+			"crudify_item" : [
+				{
+					"label" : "first item"
+				},
+				{
+					"label" : "second item"
+				}
+			]
+		}
+	`)
+	req, err := http.NewRequest("POST", url+"crudify", bytes.NewBuffer(jsonStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = execRequest(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
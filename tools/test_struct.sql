@@ -7,4 +7,12 @@ CREATE TABLE "crudify" (
 	CONSTRAINT crudify_pk PRIMARY KEY ("id")
 ) WITH (
   OIDS=FALSE
-);
\ No newline at end of file
+);
+CREATE TABLE "crudify_item" (
+	"id" serial NOT NULL,
+	"crudify_id" integer NOT NULL REFERENCES "crudify" ("id") ON DELETE CASCADE,
+	"label" VARCHAR(255) NOT NULL,
+	CONSTRAINT crudify_item_pk PRIMARY KEY ("id")
+) WITH (
+  OIDS=FALSE
+);
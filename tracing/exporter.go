@@ -0,0 +1,191 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Path of the OTLP/HTTP traces endpoint of a collector
+const TracesPath = "/v1/traces"
+
+// Service name of spans when none is configured
+const DefaultServiceName = "crudify"
+
+// Largest batch of spans sent at once, and longest delay before a span is sent
+var (
+	BatchSize     = 512
+	BatchInterval = 5 * time.Second
+)
+
+// Spans waiting to be sent, others are dropped
+const queueSize = 4096
+
+// Exporter sends ended spans in batches to an OpenTelemetry collector, as OTLP/HTTP JSON
+type Exporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+	spans       chan *Span
+}
+
+// NewExporter creates an exporter to the collector at the endpoint of tracinginfo, started by Run
+func NewExporter(tracinginfo config.TracingInfo) *Exporter {
+	serviceName := tracinginfo.ServiceName
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+	return &Exporter{
+		url:         strings.TrimSuffix(tracinginfo.Endpoint, "/") + TracesPath,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan *Span, queueSize),
+	}
+}
+
+// Export queues an ended span, it is dropped when the queue is full
+func (e *Exporter) Export(span *Span) {
+	select {
+	case e.spans <- span:
+	default:
+	}
+}
+
+// Run sends queued spans until ctx is done, then sends those left
+func (e *Exporter) Run(ctx context.Context) {
+	var batch []*Span
+
+	ticker := time.NewTicker(BatchInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) <= 0 {
+			return
+		}
+		if err := e.Send(batch); err != nil {
+			logger.Log(nil).Warn().Msg("Cannot export " + strconv.Itoa(len(batch)) + " spans: " + err.Error())
+		}
+		batch = nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case span := <-e.spans:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		case <-ticker.C:
+			flush()
+		case span := <-e.spans:
+			batch = append(batch, span)
+			if len(batch) >= BatchSize {
+				flush()
+			}
+		}
+	}
+}
+
+// OTLP value of an attribute, integers are encoded as strings
+func attributeValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	}
+	return map[string]interface{}{"stringValue": ""}
+}
+
+func attributeList(attributes map[string]interface{}) []map[string]interface{} {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, map[string]interface{}{"key": key, "value": attributeValue(attributes[key])})
+	}
+	return list
+}
+
+// Encode spans as an OTLP ExportTraceServiceRequest in JSON
+func (e *Exporter) encode(spans []*Span) ([]byte, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	otlpSpans := make([]map[string]interface{}, 0, len(spans))
+	for _, span := range spans {
+		otlpSpan := map[string]interface{}{
+			"traceId":           span.Context.TraceID.String(),
+			"spanId":            span.Context.SpanID.String(),
+			"name":              span.Name,
+			"kind":              span.Kind,
+			"startTimeUnixNano": strconv.FormatInt(span.Start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(span.End.UnixNano(), 10),
+			"attributes":        attributeList(span.Attributes()),
+			"status":            map[string]interface{}{},
+		}
+		if span.ParentID.IsValid() {
+			otlpSpan["parentSpanId"] = span.ParentID.String()
+		}
+		if err := span.Error(); err != nil {
+			otlpSpan["status"] = map[string]interface{}{"code": 2, "message": err.Error()}
+		}
+		otlpSpans = append(otlpSpans, otlpSpan)
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": attributeList(map[string]interface{}{"service.name": e.serviceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "github.com/maxime1907/crudify"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	})
+}
+
+// Send posts spans to the collector
+func (e *Exporter) Send(spans []*Span) error {
+	payload, err := e.encode(spans)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("collector answered " + resp.Status)
+	}
+	return nil
+}
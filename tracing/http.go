@@ -0,0 +1,39 @@
+package tracing
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/maxime1907/crudify/httputil"
+)
+
+// Handler traces requests of a route in a server span, child of the traceparent header of the request when valid
+// Spans of queries run by the handler are its children, and logs of the request hold its trace id
+func Handler(inner http.Handler, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, ok := ParseTraceparent(r.Header.Get(TraceparentHeader)); ok {
+			ctx = WithRemoteParent(ctx, parent)
+		}
+		ctx, span := Start(ctx, name, KindServer)
+		if span == nil {
+			inner.ServeHTTP(w, r)
+			return
+		}
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", name)
+		span.SetAttribute("http.target", r.URL.RequestURI())
+
+		recorder := httputil.NewStatusRecorder(w)
+		inner.ServeHTTP(recorder, r.WithContext(ctx))
+
+		status := recorder.Status()
+		span.SetAttribute("http.status_code", status)
+		var err error
+		if status >= http.StatusInternalServerError {
+			err = errors.New(strconv.Itoa(status) + " " + http.StatusText(status))
+		}
+		span.Finish(err)
+	})
+}
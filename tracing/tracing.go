@@ -0,0 +1,204 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header propagating the trace context, as specified by W3C Trace Context
+const TraceparentHeader = "traceparent"
+
+// Kinds of spans, numbered as in OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// Spans are created when enabled, with the text of SQL statements when Statements is set
+var Enabled = false
+var Statements = false
+
+// Exporter of ended spans, they are dropped when nil
+var DefaultExporter *Exporter
+
+// TraceID identifies a trace across services
+type TraceID [16]byte
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid tells if the id is not zero
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid tells if the id is not zero
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// SpanContext is the part of a span propagated to other services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// ParseTraceparent reads a traceparent header of version 00, such as 00-<trace id>-<parent id>-01
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil || len(traceID) != len(sc.TraceID) || parts[1] != strings.ToLower(parts[1]) {
+		return sc, false
+	}
+	spanID, err := hex.DecodeString(parts[2])
+	if err != nil || len(spanID) != len(sc.SpanID) || parts[2] != strings.ToLower(parts[2]) {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Sampled = flags[0]&1 == 1
+	return sc, sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+// Traceparent formats the span context as a traceparent header
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// Span is a timed operation of a trace, along with its attributes
+// Methods of a nil span do nothing, so that callers need not check whether tracing is enabled
+type Span struct {
+	Name     string
+	Kind     int
+	Context  SpanContext
+	ParentID SpanID
+	Start    time.Time
+	End      time.Time
+
+	mutex      sync.Mutex
+	attributes map[string]interface{}
+	err        error
+}
+
+// Keys of the span and of its trace id in the context of requests
+const (
+	spanKey    = "span"
+	parentKey  = "traceparent"
+	traceIDKey = "traceid"
+)
+
+func randomRead(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		// Ids stay valid even when the random source fails
+		b[0] = 1
+	}
+}
+
+// WithRemoteParent returns a context whose next span is a child of a span of another service
+func WithRemoteParent(ctx context.Context, parent SpanContext) context.Context {
+	return context.WithValue(ctx, parentKey, parent)
+}
+
+// FromContext returns the span of a context, nil without span
+func FromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// Start begins a span, child of the span of ctx or of its remote parent, and returns a context holding it
+// Without parent, the span begins a new sampled trace. Nothing is started when tracing is disabled
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if !Enabled {
+		return ctx, nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	span := &Span{Name: name, Kind: kind, Start: time.Now(), attributes: map[string]interface{}{}}
+	if parent := FromContext(ctx); parent != nil {
+		span.Context.TraceID, span.Context.Sampled = parent.Context.TraceID, parent.Context.Sampled
+		span.ParentID = parent.Context.SpanID
+	} else if parent, ok := ctx.Value(parentKey).(SpanContext); ok {
+		span.Context.TraceID, span.Context.Sampled = parent.TraceID, parent.Sampled
+		span.ParentID = parent.SpanID
+	} else {
+		randomRead(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	randomRead(span.Context.SpanID[:])
+
+	ctx = context.WithValue(ctx, spanKey, span)
+	ctx = context.WithValue(ctx, traceIDKey, span.Context.TraceID.String())
+	return ctx, span
+}
+
+// SetAttribute sets an attribute of the span, a string, bool, integer or float
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes[key] = value
+}
+
+// Attributes returns a copy of the attributes of the span
+func (s *Span) Attributes() map[string]interface{} {
+	attributes := map[string]interface{}{}
+	if s == nil {
+		return attributes
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, value := range s.attributes {
+		attributes[key] = value
+	}
+	return attributes
+}
+
+// Error returns the error the span ended with
+func (s *Span) Error() error {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// Finish ends the span with its error, if any, and exports it when sampled
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	s.End = time.Now()
+	s.err = err
+	s.mutex.Unlock()
+
+	if s.Context.Sampled && DefaultExporter != nil {
+		DefaultExporter.Export(s)
+	}
+}
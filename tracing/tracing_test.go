@@ -0,0 +1,128 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxime1907/crudify/config"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		valid   bool
+		sampled bool
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"future version", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"forbidden version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"upper case", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"short span id", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01", false, false},
+		{"empty", "", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc, ok := ParseTraceparent(tt.value)
+			if ok != tt.valid {
+				t.Fatalf("ParseTraceparent() valid = %v, want %v", ok, tt.valid)
+			}
+			if ok && sc.Sampled != tt.sampled {
+				t.Errorf("ParseTraceparent() sampled = %v, want %v", sc.Sampled, tt.sampled)
+			}
+			if ok && strings.HasPrefix(tt.value, "00") && sc.Traceparent() != tt.value {
+				t.Errorf("Traceparent() = %v, want %v", sc.Traceparent(), tt.value)
+			}
+		})
+	}
+}
+
+func TestStart(t *testing.T) {
+	Enabled = false
+	if _, span := Start(context.Background(), "disabled", KindInternal); span != nil {
+		t.Error("Start() created a span while tracing is disabled")
+	}
+
+	Enabled = true
+	defer func() { Enabled = false }()
+
+	parent, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, span := Start(WithRemoteParent(context.Background(), parent), "server", KindServer)
+	if span.Context.TraceID != parent.TraceID || span.ParentID != parent.SpanID || !span.Context.SpanID.IsValid() {
+		t.Errorf("Start() span context = %v, parent %v", span.Context, span.ParentID)
+	}
+	if ctx.Value(traceIDKey) != parent.TraceID.String() {
+		t.Errorf("Start() trace id in context = %v", ctx.Value(traceIDKey))
+	}
+
+	_, child := Start(ctx, "query", KindClient)
+	if child.Context.TraceID != parent.TraceID || child.ParentID != span.Context.SpanID {
+		t.Errorf("Start() child of %v = %v, parent %v", span.Context.SpanID, child.Context, child.ParentID)
+	}
+
+	_, root := Start(context.Background(), "root", KindInternal)
+	if !root.Context.TraceID.IsValid() || root.ParentID.IsValid() || !root.Context.Sampled {
+		t.Errorf("Start() root span = %v, parent %v", root.Context, root.ParentID)
+	}
+}
+
+func TestExport(t *testing.T) {
+	received := make(chan string, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != TracesPath {
+			t.Errorf("Exporter posted to %v", r.URL.Path)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		received <- string(body)
+	}))
+	defer collector.Close()
+
+	Enabled = true
+	DefaultExporter = NewExporter(config.TracingInfo{Endpoint: collector.URL, ServiceName: "gateway"})
+	defer func() { Enabled, DefaultExporter = false, nil }()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		DefaultExporter.Run(ctx)
+		close(done)
+	}()
+
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, query := Start(r.Context(), "select orders", KindClient)
+		query.SetAttribute("db.rows", int64(2))
+		query.Finish(errors.New("connection reset"))
+		w.WriteHeader(http.StatusBadGateway)
+	}), "get_orders")
+	req := httptest.NewRequest("GET", "/orders", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	cancel()
+	<-done
+	select {
+	case body := <-received:
+		for _, field := range []string{
+			`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`,
+			`"parentSpanId":"00f067aa0ba902b7"`,
+			`"name":"get_orders"`,
+			`"key":"http.status_code","value":{"intValue":"502"}`,
+			`"key":"db.rows","value":{"intValue":"2"}`,
+			`"message":"connection reset"`,
+			`"stringValue":"gateway"`,
+		} {
+			if !strings.Contains(body, field) {
+				t.Errorf("Exporter sent %v, want %v", body, field)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Exporter sent no spans")
+	}
+}
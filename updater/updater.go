@@ -0,0 +1,299 @@
+package updater
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Environment variable telling a restarted process which file descriptor holds the inherited listener
+const ListenerEnv = "CRUDIFY_LISTENER_FD"
+
+// Suffixes of the checksum, version and signature files published next to the binary
+const (
+	ChecksumSuffix  = ".sha256"
+	VersionSuffix   = ".version"
+	SignatureSuffix = ".sig"
+)
+
+// Client downloading updates
+var Client = &http.Client{Timeout: 5 * time.Minute}
+
+// Largest file downloaded, in bytes
+var MaxDownloadSize int64 = 256 << 20
+
+// Version of the running binary, a counter increased by every release and set at build time with
+// -ldflags "-X github.com/maxime1907/crudify/updater.Version=42", only newer versions are applied
+var Version = "0"
+
+// Update is a verified binary
+type Update struct {
+	Checksum string
+	Version  int64
+	Binary   []byte
+}
+
+// Enabled tells if an update URL is configured
+func Enabled(updaterinfo config.UpdaterInfo) bool {
+	return updaterinfo.Url != ""
+}
+
+// Checksum returns the hex encoded SHA-256 of content
+func Checksum(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// FileChecksum returns the hex encoded SHA-256 of a file
+func FileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Download the content of a URL
+func download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Cannot download " + url + ": " + resp.Status)
+	}
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxDownloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(content)) > MaxDownloadSize {
+		return nil, errors.New("Cannot download " + url + ": larger than " + strconv.FormatInt(MaxDownloadSize, 10) + " bytes")
+	}
+	return content, nil
+}
+
+// SignedMessage returns what the signature of a release covers: its version on a line, followed by the binary
+func SignedMessage(version int64, binary []byte) []byte {
+	return append([]byte(strconv.FormatInt(version, 10)+"\n"), binary...)
+}
+
+// Verify checks that a binary has the published checksum and is signed with its version by the private key of publicKey
+// publicKey and signature are base64 encoded
+func Verify(binary []byte, checksum string, version int64, signature string, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return errors.New("Invalid ed25519 public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil {
+		return errors.New("Invalid signature: " + err.Error())
+	}
+	if Checksum(binary) != checksum {
+		return errors.New("Checksum of downloaded binary does not match " + checksum)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), SignedMessage(version, binary), sig) {
+		return errors.New("Signature of downloaded binary is not valid")
+	}
+	return nil
+}
+
+// Check downloads the binary published at the update URL when its checksum differs from current
+// It returns nil when the binary is up to date, and an error when it is not newer than Version or cannot be verified
+func Check(ctx context.Context, updaterinfo config.UpdaterInfo, current string) (*Update, error) {
+	if updaterinfo.PublicKey == "" {
+		return nil, errors.New("Updates need a public key to verify signatures")
+	}
+
+	published, err := download(ctx, updaterinfo.Url+ChecksumSuffix)
+	if err != nil {
+		return nil, err
+	}
+	// Checksum files may hold the output of sha256sum, the checksum followed by the file name
+	fields := strings.Fields(string(published))
+	if len(fields) <= 0 {
+		return nil, errors.New("Empty checksum at " + updaterinfo.Url + ChecksumSuffix)
+	}
+	checksum := strings.ToLower(fields[0])
+	if checksum == current {
+		return nil, nil
+	}
+
+	// A signed older release must not be installed again, it may have known flaws
+	running, err := strconv.ParseInt(Version, 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid version of the running binary: " + Version)
+	}
+	published, err = download(ctx, updaterinfo.Url+VersionSuffix)
+	if err != nil {
+		return nil, err
+	}
+	version, err := strconv.ParseInt(strings.TrimSpace(string(published)), 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid version at " + updaterinfo.Url + VersionSuffix)
+	}
+	if version <= running {
+		return nil, errors.New("Published version " + strconv.FormatInt(version, 10) + " is not newer than running version " + Version)
+	}
+
+	binary, err := download(ctx, updaterinfo.Url)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := download(ctx, updaterinfo.Url+SignatureSuffix)
+	if err != nil {
+		return nil, err
+	}
+	err = Verify(binary, checksum, version, string(signature), updaterinfo.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Update{Checksum: checksum, Version: version, Binary: binary}, nil
+}
+
+// Apply replaces an executable with a binary, atomically by renaming a copy written next to it
+func Apply(executable string, binary []byte) error {
+	info, err := os.Stat(executable)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(executable), "."+filepath.Base(executable)+".update-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(binary)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode())
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), executable)
+}
+
+// Restart starts executable again with the arguments of this process, handing off the listening socket
+// The caller shuts down gracefully afterwards while the new process accepts connections
+func Restart(executable string, l net.Listener) error {
+	filer, ok := l.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errors.New("Cannot hand off a listener without file descriptor")
+	}
+	file, err := filer.File()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// ExtraFiles start at file descriptor 3, after standard input, output and error
+	cmd.ExtraFiles = []*os.File{file}
+	cmd.Env = append(os.Environ(), ListenerEnv+"=3")
+	return cmd.Start()
+}
+
+// InheritedListener returns the listener handed off by the process that restarted this one, or nil
+func InheritedListener() (net.Listener, error) {
+	fd := os.Getenv(ListenerEnv)
+	if fd == "" {
+		return nil, nil
+	}
+	os.Unsetenv(ListenerEnv)
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, errors.New("Invalid " + ListenerEnv + ": " + fd)
+	}
+	file := os.NewFile(uintptr(n), "listener")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// Poll checks for updates every interval until ctx is done
+// A verified update replaces the executable and calls restart, unless in dry-run mode where it is only logged
+func Poll(ctx context.Context, updaterinfo config.UpdaterInfo, executable string, restart func() error) {
+	interval := time.Duration(updaterinfo.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		updated, err := CheckAndApply(ctx, updaterinfo, executable)
+		if err != nil {
+			logger.Log(nil).Warn().Msg("Update failed: " + err.Error())
+			continue
+		}
+		if updated {
+			err = restart()
+			if err != nil {
+				logger.Log(nil).Error().Msg("Cannot restart after update: " + err.Error())
+				continue
+			}
+			return
+		}
+	}
+}
+
+// CheckAndApply replaces the executable by a verified update and tells if it did
+func CheckAndApply(ctx context.Context, updaterinfo config.UpdaterInfo, executable string) (bool, error) {
+	current, err := FileChecksum(executable)
+	if err != nil {
+		return false, err
+	}
+	update, err := Check(ctx, updaterinfo, current)
+	if err != nil || update == nil {
+		return false, err
+	}
+	if updaterinfo.DryRun {
+		logger.Log(nil).Info().Msg("Update " + strconv.FormatInt(update.Version, 10) + " (" + update.Checksum + ") verified, not applied in dry-run mode")
+		return false, nil
+	}
+	logger.Log(nil).Info().Msg("Applying update " + strconv.FormatInt(update.Version, 10) + " (" + update.Checksum + ") to " + executable)
+	err = Apply(executable, update.Binary)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,168 @@
+package updater
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/maxime1907/crudify/config"
+)
+
+// Serve a binary along with its checksum, its version and a signature made by key
+func serveUpdate(t *testing.T, binary []byte, version int64, key ed25519.PrivateKey) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/crudify", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(binary)
+	})
+	mux.HandleFunc("/crudify"+ChecksumSuffix, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(Checksum(binary) + "  crudify\n"))
+	})
+	mux.HandleFunc("/crudify"+VersionSuffix, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strconv.FormatInt(version, 10) + "\n"))
+	})
+	mux.HandleFunc("/crudify"+SignatureSuffix, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedMessage(version, binary)))))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCheck(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte("new binary")
+	publicKey := base64.StdEncoding.EncodeToString(public)
+
+	tests := []struct {
+		name       string
+		key        ed25519.PrivateKey
+		publicKey  string
+		current    string
+		version    int64
+		wantUpdate bool
+		wantErr    bool
+	}{
+		{"New binary", private, publicKey, Checksum([]byte("old binary")), 2, true, false},
+		{"Up to date", private, publicKey, Checksum(binary), 2, false, false},
+		{"Older version", private, publicKey, Checksum([]byte("old binary")), 1, false, true},
+		{"Signed by another key", otherPrivate, publicKey, Checksum([]byte("old binary")), 2, false, true},
+		{"Without public key", private, "", Checksum([]byte("old binary")), 2, false, true},
+	}
+	Version = "1"
+	defer func() { Version = "0" }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := serveUpdate(t, binary, tt.version, tt.key)
+			update, err := Check(context.Background(), config.UpdaterInfo{Url: srv.URL + "/crudify", PublicKey: tt.publicKey}, tt.current)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (update != nil) != tt.wantUpdate {
+				t.Fatalf("Check() update = %v, want update %v", update, tt.wantUpdate)
+			}
+			if update != nil && string(update.Binary) != string(binary) {
+				t.Errorf("Check() binary = %s, want %s", update.Binary, binary)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte("new binary")
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, SignedMessage(2, binary)))
+	publicKey := base64.StdEncoding.EncodeToString(public)
+
+	if err := Verify(binary, Checksum(binary), 2, signature, publicKey); err != nil {
+		t.Errorf("Verify() error = %v", err)
+	}
+	if err := Verify([]byte("tampered"), Checksum(binary), 2, signature, publicKey); err == nil {
+		t.Errorf("Verify() of a tampered binary error = nil")
+	}
+	if err := Verify(binary, Checksum(binary), 3, signature, publicKey); err == nil {
+		t.Errorf("Verify() with another version error = nil")
+	}
+}
+
+func TestCheckAndApply(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary := []byte("new binary")
+	srv := serveUpdate(t, binary, 1, private)
+	updaterinfo := config.UpdaterInfo{Url: srv.URL + "/crudify", PublicKey: base64.StdEncoding.EncodeToString(public)}
+
+	executable := filepath.Join(t.TempDir(), "crudify")
+	if err := ioutil.WriteFile(executable, []byte("old binary"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	updaterinfo.DryRun = true
+	updated, err := CheckAndApply(context.Background(), updaterinfo, executable)
+	if err != nil || updated {
+		t.Fatalf("CheckAndApply() in dry-run = %v %v, want no update", updated, err)
+	}
+	if content, _ := ioutil.ReadFile(executable); string(content) != "old binary" {
+		t.Errorf("CheckAndApply() in dry-run replaced the executable")
+	}
+
+	updaterinfo.DryRun = false
+	updated, err = CheckAndApply(context.Background(), updaterinfo, executable)
+	if err != nil || !updated {
+		t.Fatalf("CheckAndApply() = %v %v, want update", updated, err)
+	}
+	content, _ := ioutil.ReadFile(executable)
+	info, _ := os.Stat(executable)
+	if string(content) != string(binary) || info.Mode().Perm() != 0755 {
+		t.Errorf("CheckAndApply() executable = %s with mode %v", content, info.Mode())
+	}
+
+	updated, err = CheckAndApply(context.Background(), updaterinfo, executable)
+	if err != nil || updated {
+		t.Errorf("CheckAndApply() when up to date = %v %v, want no update", updated, err)
+	}
+}
+
+func TestInheritedListener(t *testing.T) {
+	os.Unsetenv(ListenerEnv)
+	l, err := InheritedListener()
+	if l != nil || err != nil {
+		t.Errorf("InheritedListener() without handoff = %v %v, want nil", l, err)
+	}
+}
+
+func TestDownloadLimit(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer srv.Close()
+	defer func(size int64) { MaxDownloadSize = size }(MaxDownloadSize)
+
+	MaxDownloadSize = 10
+	if content, err := download(context.Background(), srv.URL); err != nil || string(content) != "0123456789" {
+		t.Errorf("download() = %s %v, want the whole content", content, err)
+	}
+	MaxDownloadSize = 9
+	if _, err := download(context.Background(), srv.URL); err == nil {
+		t.Errorf("download() of a larger file error = nil")
+	}
+}
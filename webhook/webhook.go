@@ -0,0 +1,314 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/json-iterator/go"
+	"github.com/maxime1907/crudify/apierror"
+	"github.com/maxime1907/crudify/auth"
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
+	"github.com/maxime1907/crudify/handler"
+	"github.com/maxime1907/crudify/logger"
+)
+
+// Headers of webhook requests
+const (
+	SignatureHeader = "X-Crudify-Signature"
+	EventHeader     = "X-Crudify-Event"
+	DeliveryHeader  = "X-Crudify-Delivery"
+)
+
+// Status of deliveries
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// Attempts of a delivery when none are configured
+const DefaultRetries = 5
+
+// Delay before the first retry, doubled after every failed attempt
+var RetryDelay = 10 * time.Second
+
+// Deliveries kept for the admin endpoint, and deliveries waiting to be sent to each URL
+const (
+	historySize = 1000
+	queueSize   = 1000
+)
+
+// Delivery is the POST of an event to a subscribed URL
+type Delivery struct {
+	ID         string    `json:"id"`
+	Url        string    `json:"url"`
+	Table      string    `json:"table"`
+	Operation  string    `json:"operation"`
+	UUID       string    `json:"uuid,omitempty"`
+	Status     string    `json:"status"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+
+	secret  string
+	payload []byte
+}
+
+// Enabled tells if webhooks are subscribed
+func Enabled(webhooksinfo config.WebhooksInfo) bool {
+	return len(webhooksinfo.Subscriptions) > 0
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of a payload, sent as "sha256=<signature>"
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher delivers events to subscribed URLs in the background, retrying failed deliveries
+// Each URL has its own queue, so that a slow receiver only delays its own deliveries
+type Dispatcher struct {
+	webhooksinfo config.WebhooksInfo
+	client       *http.Client
+	queues       map[string]chan *Delivery
+	pending      sync.WaitGroup
+	mutex        sync.RWMutex
+	history      []*Delivery
+	lastID       int64
+}
+
+// NewDispatcher creates a dispatcher for subscriptions, started by Run
+func NewDispatcher(webhooksinfo config.WebhooksInfo) *Dispatcher {
+	timeout := time.Duration(webhooksinfo.Timeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	queues := map[string]chan *Delivery{}
+	for _, subscription := range webhooksinfo.Subscriptions {
+		if _, ok := queues[subscription.Url]; !ok {
+			queues[subscription.Url] = make(chan *Delivery, queueSize)
+		}
+	}
+	return &Dispatcher{
+		webhooksinfo: webhooksinfo,
+		client:       &http.Client{Timeout: timeout},
+		queues:       queues,
+	}
+}
+
+// Notify queues a delivery for every subscription matching an event, it is a dbhelper.Listener
+func (d *Dispatcher) Notify(r *http.Request, event dbhelper.Event) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+
+	for _, subscription := range d.webhooksinfo.Subscriptions {
+		if subscription.Table != event.Table || !dbhelper.MatchOperation(subscription.Operations, event.Operation) {
+			continue
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			logger.Log(r).Error().Msg("Cannot encode webhook payload: " + err.Error())
+			return
+		}
+
+		d.mutex.Lock()
+		d.lastID++
+		delivery := &Delivery{
+			ID:        strconv.FormatInt(d.lastID, 10),
+			Url:       subscription.Url,
+			Table:     event.Table,
+			Operation: event.Operation,
+			UUID:      event.UUID,
+			Status:    StatusPending,
+			CreatedAt: time.Now(),
+			UpdatedAt: time.Now(),
+			secret:    subscription.Secret,
+			payload:   payload,
+		}
+		d.history = append(d.history, delivery)
+		if len(d.history) > historySize {
+			d.history = d.history[len(d.history)-historySize:]
+		}
+		d.mutex.Unlock()
+
+		d.push(delivery)
+	}
+}
+
+func (d *Dispatcher) push(delivery *Delivery) {
+	select {
+	case d.queues[delivery.Url] <- delivery:
+	default:
+		d.fail(delivery, errors.New("webhook queue is full"))
+	}
+}
+
+// Run delivers queued events until ctx is done, URLs being delivered concurrently and each one in order
+func (d *Dispatcher) Run(ctx context.Context) {
+	var workers sync.WaitGroup
+
+	for _, queue := range d.queues {
+		workers.Add(1)
+		go func(queue chan *Delivery) {
+			defer workers.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case delivery := <-queue:
+					d.deliver(ctx, delivery)
+				}
+			}
+		}(queue)
+	}
+	workers.Wait()
+	d.pending.Wait()
+
+	var left int
+	for _, queue := range d.queues {
+		left += len(queue)
+	}
+	if left > 0 {
+		logger.Log(nil).Warn().Msg(strconv.Itoa(left) + " webhooks were not delivered before shutdown")
+	}
+}
+
+// POST the payload of a delivery, any status other than 2xx is a failure
+func (d *Dispatcher) send(ctx context.Context, delivery *Delivery) (int, error) {
+	req, err := http.NewRequest("POST", delivery.Url, bytes.NewReader(delivery.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, delivery.Table+"."+delivery.Operation)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	if delivery.secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign(delivery.secret, delivery.payload))
+	}
+
+	resp, err := d.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.New("webhook answered " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery *Delivery) {
+	retries := d.webhooksinfo.Retries
+	if retries <= 0 {
+		retries = DefaultRetries
+	}
+
+	statusCode, err := d.send(ctx, delivery)
+
+	d.mutex.Lock()
+	delivery.Attempts++
+	delivery.StatusCode = statusCode
+	delivery.UpdatedAt = time.Now()
+	if err == nil {
+		delivery.Status, delivery.Error = StatusDelivered, ""
+	} else {
+		delivery.Error = err.Error()
+	}
+	attempts := delivery.Attempts
+	d.mutex.Unlock()
+
+	if err == nil {
+		return
+	}
+	if attempts >= retries {
+		d.fail(delivery, err)
+		return
+	}
+	logger.Log(nil).Warn().Msg("Cannot deliver webhook " + delivery.ID + " to " + delivery.Url + ", retrying: " + err.Error())
+
+	delay := RetryDelay * time.Duration(1<<uint(attempts-1))
+	d.pending.Add(1)
+	go func() {
+		defer d.pending.Done()
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+			d.push(delivery)
+		}
+	}()
+}
+
+// Record a delivery that will not be retried in the dead letter table, when configured
+func (d *Dispatcher) fail(delivery *Delivery, err error) {
+	d.mutex.Lock()
+	delivery.Status, delivery.Error, delivery.UpdatedAt = StatusFailed, err.Error(), time.Now()
+	d.mutex.Unlock()
+
+	logger.Log(nil).Error().Msg("Webhook " + delivery.ID + " to " + delivery.Url + " failed: " + err.Error())
+	if d.webhooksinfo.DeadLetterTable == "" {
+		return
+	}
+	_, err = dbhelper.Insert(nil, d.webhooksinfo.DeadLetterTable, map[string]string{}, []map[string]interface{}{
+		{
+			"url":        delivery.Url,
+			"event":      delivery.Table + "." + delivery.Operation,
+			"payload":    string(delivery.payload),
+			"attempts":   delivery.Attempts,
+			"error":      delivery.Error,
+			"created_at": delivery.CreatedAt,
+		},
+	})
+	if err != nil {
+		logger.Log(nil).Error().Msg("Cannot record failed webhook " + delivery.ID + ": " + err.Error())
+	}
+}
+
+// Deliveries returns the latest deliveries, most recent first
+func (d *Dispatcher) Deliveries() []Delivery {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	deliveries := make([]Delivery, 0, len(d.history))
+	for i := len(d.history) - 1; i >= 0; i-- {
+		deliveries = append(deliveries, *d.history[i])
+	}
+	return deliveries
+}
+
+// DeliveriesGet answers the latest deliveries, filtered by the status argument
+// Only the admin role may list them, nobody may when it is not configured
+func (d *Dispatcher) DeliveriesGet(w http.ResponseWriter, r *http.Request) {
+	var err error
+	var result []Delivery
+
+	if d.webhooksinfo.AdminRole == "" {
+		err = apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Webhook deliveries are not listed without an admin role")
+	} else if auth.GetRequestRole(r) != d.webhooksinfo.AdminRole {
+		err = apierror.New(http.StatusForbidden, apierror.CodeForbidden, "Webhook deliveries are only listed to "+d.webhooksinfo.AdminRole)
+	} else {
+		status := r.FormValue("status")
+		for _, delivery := range d.Deliveries() {
+			if status == "" || delivery.Status == status {
+				result = append(result, delivery)
+			}
+		}
+	}
+	if err != nil {
+		logger.Log(r).Warn().Msg(err.Error())
+	}
+	err = handler.SendAnswer(w, r, result, err)
+	if err != nil {
+		logger.Log(r).Warn().Msg(err.Error())
+	}
+}
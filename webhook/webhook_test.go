@@ -0,0 +1,112 @@
+package webhook
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maxime1907/crudify/config"
+	"github.com/maxime1907/crudify/dbhelper"
+)
+
+func TestDispatcher(t *testing.T) {
+	RetryDelay = 10 * time.Millisecond
+
+	var mutex sync.Mutex
+	var calls int
+	received := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		calls++
+		first := calls == 1
+		mutex.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != "sha256="+Sign("secret", body) {
+			t.Errorf("Webhook signature = %v", r.Header.Get(SignatureHeader))
+		}
+		if r.Header.Get(EventHeader) != "orders.insert" {
+			t.Errorf("Webhook event = %v", r.Header.Get(EventHeader))
+		}
+		received <- string(body)
+	}))
+	defer receiver.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	dispatcher := NewDispatcher(config.WebhooksInfo{
+		Retries: 2,
+		Subscriptions: []config.WebhookInfo{
+			{Table: "orders", Operations: []string{"insert"}, Url: receiver.URL, Secret: "secret"},
+			{Table: "orders", Operations: []string{"insert"}, Url: failing.URL},
+			{Table: "customers", Url: receiver.URL},
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go dispatcher.Run(ctx)
+
+	dispatcher.Notify(nil, dbhelper.Event{Table: "orders", Operation: dbhelper.OperationDelete})
+	dispatcher.Notify(nil, dbhelper.Event{Table: "orders", Operation: dbhelper.OperationInsert, UUID: "42", Rows: []map[string]interface{}{{"id": 1}}})
+
+	select {
+	case body := <-received:
+		if !strings.Contains(body, `"uuid":"42"`) || !strings.Contains(body, `"rows":[{"id":1}]`) {
+			t.Errorf("Webhook payload = %v", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify() delivered no webhook after a retry")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries := dispatcher.Deliveries()
+		if len(deliveries) != 2 {
+			t.Fatalf("Deliveries() = %v, want 2 deliveries", deliveries)
+		}
+		statuses := map[string]string{}
+		for _, delivery := range deliveries {
+			statuses[delivery.Url] = delivery.Status
+		}
+		if statuses[receiver.URL] == StatusDelivered && statuses[failing.URL] == StatusFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Deliveries() statuses = %v", statuses)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeliveriesGet(t *testing.T) {
+	req := httptest.NewRequest("GET", "/_webhooks/deliveries", nil)
+	req = req.WithContext(context.WithValue(req.Context(), "role", "admin"))
+	w := httptest.NewRecorder()
+	NewDispatcher(config.WebhooksInfo{}).DeliveriesGet(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("DeliveriesGet() without configured admin role status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	dispatcher := NewDispatcher(config.WebhooksInfo{AdminRole: "admin"})
+	w = httptest.NewRecorder()
+	dispatcher.DeliveriesGet(w, httptest.NewRequest("GET", "/_webhooks/deliveries", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("DeliveriesGet() without admin role status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+
+	w = httptest.NewRecorder()
+	dispatcher.DeliveriesGet(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("DeliveriesGet() status = %v, want %v", w.Code, http.StatusOK)
+	}
+}